@@ -0,0 +1,279 @@
+package bep
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+const (
+	// StatusFile is the name of the build status file in the gobazel state
+	// directory.
+	StatusFile = "build-status.json"
+
+	maxStderr = 64 * 1024
+)
+
+// Status is the status of the bazel builds gobazel ran in the background, as
+// written to the status file.
+type Status struct {
+	LastBuild *Build             `json:"lastBuild,omitempty"`
+	Targets   map[string]*Target `json:"targets"`
+}
+
+// Build describes a bazel invocation.
+type Build struct {
+	Command  string    `json:"command"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Elapsed  float64   `json:"elapsed"`
+	Success  bool      `json:"success"`
+	ExitCode int       `json:"exitCode"`
+	ExitName string    `json:"exitName,omitempty"`
+	// Failed are the labels of the failed targets.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// Target is the result of a bazel target in the latest build of it.
+type Target struct {
+	Kind     string         `json:"kind,omitempty"`
+	Success  bool           `json:"success"`
+	Finished time.Time      `json:"finished"`
+	Aborted  string         `json:"aborted,omitempty"`
+	Errors   []*ActionError `json:"errors,omitempty"`
+}
+
+// ActionError is a failed action of a target.
+type ActionError struct {
+	Mnemonic string `json:"mnemonic,omitempty"`
+	ExitCode int    `json:"exitCode"`
+	Stderr   string `json:"stderr,omitempty"`
+}
+
+type labelID struct {
+	Label string `json:"label"`
+}
+
+type file struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+}
+
+// event is the part of a build event (in JSON) gobazel is interested in.
+type event struct {
+	ID struct {
+		TargetConfigured *labelID `json:"targetConfigured"`
+		TargetCompleted  *labelID `json:"targetCompleted"`
+		ActionCompleted  *labelID `json:"actionCompleted"`
+	} `json:"id"`
+
+	Started *struct {
+		StartTimeMillis int64     `json:"startTimeMillis,string"`
+		StartTime       time.Time `json:"startTime"`
+	} `json:"started"`
+	Configured *struct {
+		TargetKind string `json:"targetKind"`
+	} `json:"configured"`
+	Completed *struct {
+		Success bool `json:"success"`
+	} `json:"completed"`
+	Aborted *struct {
+		Reason      string `json:"reason"`
+		Description string `json:"description"`
+	} `json:"aborted"`
+	Action *struct {
+		Success  bool   `json:"success"`
+		Label    string `json:"label"`
+		Type     string `json:"type"`
+		ExitCode int    `json:"exitCode"`
+		Stderr   *file  `json:"stderr"`
+	} `json:"action"`
+	Finished *struct {
+		OverallSuccess bool `json:"overallSuccess"`
+		ExitCode       *struct {
+			Name string `json:"name"`
+			Code int    `json:"code"`
+		} `json:"exitCode"`
+		FinishTimeMillis int64     `json:"finishTimeMillis,string"`
+		FinishTime       time.Time `json:"finishTime"`
+	} `json:"finished"`
+}
+
+// Recorder records the results of bazel builds in the status file.
+type Recorder struct {
+	mu   sync.Mutex
+	file string
+	rw   *pathmap.Rewriter
+}
+
+// Record parses the build events (written by bazel with
+// --build_event_json_file) of the given command, and merges the results
+// into the status file.
+func (r *Recorder) Record(command, eventFile string) (*Build, error) {
+	build, targets, err := r.parse(eventFile)
+	if err != nil {
+		return nil, err
+	}
+	build.Command = command
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := Status{}
+	if b, err := ioutil.ReadFile(r.file); err == nil {
+		json.Unmarshal(b, &status)
+	}
+	if status.Targets == nil {
+		status.Targets = map[string]*Target{}
+	}
+	status.LastBuild = build
+	for label, t := range targets {
+		status.Targets[label] = t
+	}
+
+	b, err := json.MarshalIndent(&status, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// Editors may read the file at any time, replace it atomically.
+	tmp := r.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return build, os.Rename(tmp, r.file)
+}
+
+func (r *Recorder) parse(eventFile string) (*Build, map[string]*Target, error) {
+	f, err := os.Open(eventFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	build := Build{}
+	targets := map[string]*Target{}
+	target := func(label string) *Target {
+		t, ok := targets[label]
+		if !ok {
+			t = &Target{}
+			targets[label] = t
+		}
+		return t
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		e := event{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip events not understood.
+			continue
+		}
+
+		switch {
+		case e.Started != nil:
+			build.Started = eventTime(e.Started.StartTime, e.Started.StartTimeMillis)
+		case e.Configured != nil && e.ID.TargetConfigured != nil:
+			target(e.ID.TargetConfigured.Label).Kind = strings.TrimSuffix(e.Configured.TargetKind, " rule")
+		case e.ID.TargetCompleted != nil:
+			t := target(e.ID.TargetCompleted.Label)
+			t.Success = e.Completed != nil && e.Completed.Success
+			if e.Aborted != nil {
+				t.Aborted = r.rw.Rewrite(strings.TrimSpace(e.Aborted.Reason + " " + e.Aborted.Description))
+			}
+		case e.Action != nil && !e.Action.Success:
+			label := e.Action.Label
+			if label == "" && e.ID.ActionCompleted != nil {
+				label = e.ID.ActionCompleted.Label
+			}
+			if label == "" {
+				continue
+			}
+			t := target(label)
+			t.Errors = append(t.Errors, &ActionError{
+				Mnemonic: e.Action.Type,
+				ExitCode: e.Action.ExitCode,
+				Stderr:   r.readStderr(e.Action.Stderr),
+			})
+		case e.Finished != nil:
+			build.Finished = eventTime(e.Finished.FinishTime, e.Finished.FinishTimeMillis)
+			build.Success = e.Finished.OverallSuccess
+			if ec := e.Finished.ExitCode; ec != nil {
+				build.ExitCode, build.ExitName = ec.Code, ec.Name
+				build.Success = ec.Code == 0
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read build events %s, %v", eventFile, err)
+	}
+
+	if !build.Started.IsZero() && !build.Finished.IsZero() {
+		build.Elapsed = build.Finished.Sub(build.Started).Seconds()
+	}
+	for label, t := range targets {
+		t.Finished = build.Finished
+		if len(t.Errors) > 0 {
+			t.Success = false
+		}
+		if !t.Success {
+			build.Failed = append(build.Failed, label)
+		}
+	}
+	sort.Strings(build.Failed)
+	return &build, targets, nil
+}
+
+// readStderr returns the stderr of a failed action with paths translated
+// into the virtual GOPATH.
+func (r *Recorder) readStderr(f *file) string {
+	if f == nil {
+		return ""
+	}
+	u, err := url.Parse(f.URI)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	b, err := ioutil.ReadFile(u.Path)
+	if err != nil {
+		return ""
+	}
+	if len(b) > maxStderr {
+		b = b[:maxStderr]
+	}
+
+	lines := strings.SplitAfter(string(b), "\n")
+	for i, line := range lines {
+		lines[i] = r.rw.Rewrite(line)
+	}
+	return strings.Join(lines, "")
+}
+
+func eventTime(t time.Time, millis int64) time.Time {
+	if !t.IsZero() {
+		return t
+	}
+	if millis > 0 {
+		return time.Unix(0, millis*int64(time.Millisecond))
+	}
+	return time.Time{}
+}
+
+// NewRecorder returns a new Recorder writing the status file in the given
+// gobazel state directory, with paths in error messages rewritten by rw.
+func NewRecorder(stateDir string, rw *pathmap.Rewriter) *Recorder {
+	return &Recorder{
+		file: filepath.Join(stateDir, StatusFile),
+		rw:   rw,
+	}
+}
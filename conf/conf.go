@@ -3,31 +3,113 @@ package conf
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/linuxerwang/confish"
 )
 
-// GobazelConf represents the bazel build config.
+// BuildConf represents the bazel build config.
 type BuildConf struct {
-	Rules   []string `cfg-attr:"rules"`
-	Ignores []string `cfg-attr:"ignore-dirs"`
+	Rules     []string `cfg-attr:"rules"`
+	Ignores   []string `cfg-attr:"ignore-dirs"`
+	Queries   []string `cfg-attr:"queries"`
+	KeepGoing bool     `cfg-attr:"keep-going"`
+	Flags     []string `cfg-attr:"flags"`
+	Configs   []string `cfg-attr:"configs"`
+}
+
+// BazelConf represents the options of the bazel commands gobazel runs in
+// the background.
+type BazelConf struct {
+	OutputBase string `cfg-attr:"output-base"`
+	DiskCache  string `cfg-attr:"disk-cache"`
+}
+
+// LazyGenConf represents the config of generating missing code on first
+// access of a package.
+type LazyGenConf struct {
+	Rules    []string `cfg-attr:"rules"`
+	Wait     string   `cfg-attr:"wait"`
+	Timeout  string   `cfg-attr:"timeout"`
+	CoolDown string   `cfg-attr:"cool-down"`
+
+	WaitDuration     time.Duration
+	TimeoutDuration  time.Duration
+	CoolDownDuration time.Duration
+}
+
+// KernelCacheConf represents how long the kernel caches the entries,
+// attributes and missing entries of the virtual tree.
+type KernelCacheConf struct {
+	EntryTimeout    string `cfg-attr:"entry-timeout"`
+	AttrTimeout     string `cfg-attr:"attr-timeout"`
+	NegativeTimeout string `cfg-attr:"negative-timeout"`
+
+	EntryTimeoutDuration    time.Duration
+	AttrTimeoutDuration     time.Duration
+	NegativeTimeoutDuration time.Duration
+}
+
+// HookConf represents a command run when matching files change.
+type HookConf struct {
+	Name        string   `cfg-attr:"name"`
+	Paths       []string `cfg-attr:"paths"`
+	Events      []string `cfg-attr:"events"`
+	Command     string   `cfg-attr:"command"`
+	Timeout     string   `cfg-attr:"timeout"`
+	Concurrency int      `cfg-attr:"concurrency"`
+	Batch       bool     `cfg-attr:"batch"`
+	RdepsKinds  []string `cfg-attr:"rdeps-kinds"`
+	Disabled    bool     `cfg-attr:"disabled"`
+
+	TimeoutDuration time.Duration
+}
+
+// HooksConf represents the on-change hooks config.
+type HooksConf struct {
+	QuietWindow string      `cfg-attr:"quiet-window"`
+	MaxPending  int         `cfg-attr:"max-pending"`
+	Hooks       []*HookConf `cfg-attr:"hook"`
+
+	QuietWindowDuration time.Duration
 }
 
 // GobazelConf represents the gobazel global config.
 type GobazelConf struct {
-	GoPath      string     `cfg-attr:"go-path"`
-	GoPkgPrefix string     `cfg-attr:"go-pkg-prefix"`
-	GoIdeCmd    string     `cfg-attr:"go-ide-cmd"`
-	Ignores     []string   `cfg-attr:"ignore-dirs"`
-	Vendors     []string   `cfg-attr:"vendor-dirs"`
-	FallThrough []string   `cfg-attr:"fall-through-dirs"`
-	Build       *BuildConf `cfg-attr:"build"`
+	GoPath      string           `cfg-attr:"go-path"`
+	GoPkgPrefix string           `cfg-attr:"go-pkg-prefix"`
+	GoIdeCmd    string           `cfg-attr:"go-ide-cmd"`
+	Ignores     []string         `cfg-attr:"ignore-dirs"`
+	Vendors     []string         `cfg-attr:"vendor-dirs"`
+	FallThrough []string         `cfg-attr:"fall-through-dirs"`
+	Build       *BuildConf       `cfg-attr:"build"`
+	Hooks       *HooksConf       `cfg-attr:"hooks"`
+	Bazel       *BazelConf       `cfg-attr:"bazel"`
+	LazyGen     *LazyGenConf     `cfg-attr:"lazy-generate"`
+	SnapshotGen bool             `cfg-attr:"snapshot-genfiles"`
+	KernelCache *KernelCacheConf `cfg-attr:"kernel-cache"`
+	Passthrough bool             `cfg-attr:"passthrough"`
 
 	IgnoreSet      map[string]struct{}
 	VendorSet      map[string]struct{}
 	FallThroughSet map[string]struct{}
 }
 
+const (
+	defaultHookTimeout = 5 * time.Minute
+	defaultQuietWindow = 300 * time.Millisecond
+	defaultMaxPending  = 10000
+
+	defaultLazyGenWait     = time.Second
+	defaultLazyGenTimeout  = 5 * time.Minute
+	defaultLazyGenCoolDown = time.Minute
+
+	defaultEntryTimeout    = 10 * time.Second
+	defaultAttrTimeout     = 10 * time.Second
+	defaultNegativeTimeout = 10 * time.Second
+)
+
 type confWrapper struct {
 	Conf *GobazelConf `cfg-attr:"gobazel"`
 }
@@ -42,9 +124,210 @@ func LoadConfig(cfgPath string) *GobazelConf {
 	cfg.Conf.IgnoreSet = toSet(cfg.Conf.Ignores)
 	cfg.Conf.VendorSet = toSet(cfg.Conf.Vendors)
 	cfg.Conf.FallThroughSet = toSet(cfg.Conf.FallThrough)
+
+	if cfg.Conf.Hooks == nil {
+		cfg.Conf.Hooks = &HooksConf{Hooks: defaultHooks()}
+	}
+	if err := cfg.Conf.Hooks.init(); err != nil {
+		fmt.Printf("Invalid hooks in gobazel config file %s, %v.\n", cfgPath, err)
+		os.Exit(2)
+	}
+	if cfg.Conf.LazyGen != nil {
+		if err := cfg.Conf.LazyGen.init(); err != nil {
+			fmt.Printf("Invalid lazy-generate in gobazel config file %s, %v.\n", cfgPath, err)
+			os.Exit(2)
+		}
+	}
+	if cfg.Conf.KernelCache == nil {
+		cfg.Conf.KernelCache = &KernelCacheConf{}
+	}
+	if err := cfg.Conf.KernelCache.init(); err != nil {
+		fmt.Printf("Invalid kernel-cache in gobazel config file %s, %v.\n", cfgPath, err)
+		os.Exit(2)
+	}
 	return cfg.Conf
 }
 
+func (kc *KernelCacheConf) init() error {
+	var err error
+	if kc.EntryTimeoutDuration, err = parseDuration("entry-timeout", kc.EntryTimeout, defaultEntryTimeout); err != nil {
+		return err
+	}
+	if kc.AttrTimeoutDuration, err = parseDuration("attr-timeout", kc.AttrTimeout, defaultAttrTimeout); err != nil {
+		return err
+	}
+	if kc.NegativeTimeoutDuration, err = parseDuration("negative-timeout", kc.NegativeTimeout, defaultNegativeTimeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (lc *LazyGenConf) init() error {
+	if len(lc.Rules) == 0 {
+		lc.Rules = defaultRdepsKinds
+	}
+
+	var err error
+	if lc.WaitDuration, err = parseDuration("wait", lc.Wait, defaultLazyGenWait); err != nil {
+		return err
+	}
+	if lc.TimeoutDuration, err = parseDuration("timeout", lc.Timeout, defaultLazyGenTimeout); err != nil {
+		return err
+	}
+	if lc.CoolDownDuration, err = parseDuration("cool-down", lc.CoolDown, defaultLazyGenCoolDown); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+func (hc *HooksConf) init() error {
+	var err error
+	if hc.QuietWindowDuration, err = parseDuration("quiet-window", hc.QuietWindow, defaultQuietWindow); err != nil {
+		return err
+	}
+	if hc.MaxPending <= 0 {
+		hc.MaxPending = defaultMaxPending
+	}
+
+	for _, h := range hc.Hooks {
+		if err := h.init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	// HookEvents are the file events hooks can react to.
+	HookEvents = []string{"create", "write", "remove", "rename"}
+
+	defaultRdepsKinds = []string{"go_proto_library"}
+)
+
+func (h *HookConf) init() error {
+	// Commands aren't run by a shell, they're split on white space.
+	if len(strings.Fields(h.Command)) == 0 {
+		return fmt.Errorf("hook %q has no command", h.Name)
+	}
+	if h.Name == "" {
+		h.Name = h.Command
+	}
+	if len(h.Events) == 0 {
+		h.Events = HookEvents
+	}
+	for _, e := range h.Events {
+		if _, ok := toSet(HookEvents)[e]; !ok {
+			return fmt.Errorf("hook %q has unknown event %q", h.Name, e)
+		}
+	}
+	if len(h.RdepsKinds) == 0 {
+		h.RdepsKinds = defaultRdepsKinds
+	}
+	if h.Concurrency <= 0 {
+		h.Concurrency = 1
+	}
+
+	var err error
+	if h.TimeoutDuration, err = parseDuration("timeout", h.Timeout, defaultHookTimeout); err != nil {
+		return fmt.Errorf("hook %q has %v", h.Name, err)
+	}
+	if h.TimeoutDuration <= 0 {
+		// The hook would be canceled right away.
+		return fmt.Errorf("hook %q has invalid timeout %q", h.Name, h.Timeout)
+	}
+	return nil
+}
+
+// defaultHooks returns the hooks used when .gobazelrc has no hooks section:
+// build the Go proto libraries depending on changed .proto files and "go
+// install" the Go package of changed .go and .proto files.
+func defaultHooks() []*HookConf {
+	return []*HookConf{
+		{
+			Name:       "bazel-build-proto",
+			Paths:      []string{"**/*.proto"},
+			Command:    "bazel build {rdeps}",
+			RdepsKinds: defaultRdepsKinds,
+			Batch:      true,
+		},
+		{
+			Name:        "go-install",
+			Paths:       []string{"**/*.go", "**/*.proto"},
+			Events:      HookEvents,
+			Command:     "go install {importpath}",
+			Batch:       true,
+			Timeout:     shortDuration(defaultHookTimeout),
+			Concurrency: 1,
+		},
+	}
+}
+
+// DefaultHooksSection returns the hooks section of the default hooks, as
+// written into a new .gobazelrc, with each line indented by indent.
+func DefaultHooksSection(indent string) string {
+	sb := strings.Builder{}
+	line := func(depth int, format string, args ...interface{}) {
+		sb.WriteString(indent + strings.Repeat("    ", depth) + fmt.Sprintf(format, args...) + "\n")
+	}
+	list := func(depth int, name string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		line(depth, "%s: [", name)
+		for _, v := range values {
+			line(depth+1, "%q,", v)
+		}
+		line(depth, "]")
+	}
+
+	line(0, "hooks {")
+	line(1, "quiet-window: %q", shortDuration(defaultQuietWindow))
+	line(1, "max-pending: %d", defaultMaxPending)
+	for _, h := range defaultHooks() {
+		line(1, "hook {")
+		line(2, "name: %q", h.Name)
+		list(2, "paths", h.Paths)
+		list(2, "events", h.Events)
+		line(2, "command: %q", h.Command)
+		list(2, "rdeps-kinds", h.RdepsKinds)
+		line(2, "batch: %v", h.Batch)
+		if h.Timeout != "" {
+			line(2, "timeout: %q", h.Timeout)
+		}
+		if h.Concurrency > 0 {
+			line(2, "concurrency: %d", h.Concurrency)
+		}
+		line(2, "disabled: %v", h.Disabled)
+		line(1, "}")
+	}
+	line(0, "}")
+	return sb.String()
+}
+
+// shortDuration formats d without zero minutes or seconds, e.g., "5m"
+// rather than "5m0s".
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
 func toSet(slice []string) map[string]struct{} {
 	set := map[string]struct{}{}
 	for _, ele := range slice {
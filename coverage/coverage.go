@@ -0,0 +1,174 @@
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+// Converter rewrites LCOV reports written by "bazel coverage" into the
+// virtual GOPATH, and converts them into Go coverprofiles.
+type Converter struct {
+	mapper      *pathmap.Mapper
+	genfilesDir string
+	// lines caches the line lengths of source files.
+	lines map[string][]int
+}
+
+type fileCoverage struct {
+	importPath string
+	rel        string
+	counts     map[int]int
+}
+
+// Convert reads the LCOV report from r. It writes the report with all SF:
+// paths rewritten to the virtual GOPATH to lcov, and the Go coverprofile
+// keyed by import path to profile.
+func (c *Converter) Convert(r io.Reader, lcov, profile io.Writer) error {
+	files := map[string]*fileCoverage{}
+	var cur *fileCoverage
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			cur = nil
+			sf := line[len("SF:"):]
+			rel, ok := c.sourceRel(sf)
+			if !ok {
+				break
+			}
+			line = "SF:" + c.mapper.Virtual(rel)
+
+			importPath := c.mapper.ImportPath(filepath.Dir(rel)) + "/" + filepath.Base(rel)
+			if cur = files[importPath]; cur == nil {
+				cur = &fileCoverage{importPath: importPath, rel: rel, counts: map[int]int{}}
+				files[importPath] = cur
+			}
+		case strings.HasPrefix(line, "DA:") && cur != nil:
+			parts := strings.Split(line[len("DA:"):], ",")
+			if len(parts) < 2 {
+				break
+			}
+			ln, err1 := strconv.Atoi(parts[0])
+			count, err2 := strconv.Atoi(parts[1])
+			if err1 == nil && err2 == nil {
+				cur.counts[ln] += count
+			}
+		case line == "end_of_record":
+			cur = nil
+		}
+
+		if _, err := fmt.Fprintln(lcov, line); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	return c.writeProfile(profile, files)
+}
+
+func (c *Converter) writeProfile(w io.Writer, files map[string]*fileCoverage) error {
+	if _, err := fmt.Fprintln(w, "mode: count"); err != nil {
+		return err
+	}
+
+	importPaths := make([]string, 0, len(files))
+	for ip := range files {
+		importPaths = append(importPaths, ip)
+	}
+	sort.Strings(importPaths)
+
+	for _, ip := range importPaths {
+		fc := files[ip]
+		lengths := c.lineLengths(fc.rel)
+
+		lns := make([]int, 0, len(fc.counts))
+		for ln := range fc.counts {
+			lns = append(lns, ln)
+		}
+		sort.Ints(lns)
+
+		// LCOV only has line coverage, every line becomes a block.
+		for _, ln := range lns {
+			endCol := 2
+			if ln <= len(lengths) && lengths[ln-1]+1 > endCol {
+				endCol = lengths[ln-1] + 1
+			}
+			if _, err := fmt.Fprintf(w, "%s:%d.1,%d.%d 1 %d\n", ip, ln, ln, endCol, fc.counts[ln]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sourceRel returns the workspace relative path of an SF: path, which is
+// either workspace relative, an execroot path or an import path. Existing
+// source files go first, then import paths, else the path is taken as
+// workspace relative.
+func (c *Converter) sourceRel(sf string) (string, bool) {
+	rel, ok := c.mapper.Rel(sf)
+	if !ok {
+		return "", false
+	}
+	if c.sourceFile(rel) != "" {
+		return rel, true
+	}
+
+	if dir, ok := c.mapper.ImportPathDir(filepath.Dir(rel)); ok {
+		return filepath.Join(dir, filepath.Base(rel)), true
+	}
+	return rel, true
+}
+
+// sourceFile returns the real path of the workspace relative source file,
+// which is either in the workspace or generated.
+func (c *Converter) sourceFile(rel string) string {
+	for _, dir := range []string{c.mapper.Workspace(), c.genfilesDir} {
+		fname := filepath.Join(dir, rel)
+		if fi, err := os.Stat(fname); err == nil && !fi.IsDir() {
+			return fname
+		}
+	}
+	return ""
+}
+
+func (c *Converter) lineLengths(rel string) []int {
+	if lengths, ok := c.lines[rel]; ok {
+		return lengths
+	}
+
+	var lengths []int
+	if fname := c.sourceFile(rel); fname != "" {
+		if b, err := ioutil.ReadFile(fname); err == nil {
+			for _, l := range strings.Split(string(b), "\n") {
+				lengths = append(lengths, len(l))
+			}
+		}
+	}
+	c.lines[rel] = lengths
+	return lengths
+}
+
+// NewConverter returns a new Converter, which looks up generated source
+// files in genfilesDir.
+func NewConverter(mapper *pathmap.Mapper, genfilesDir string) *Converter {
+	return &Converter{
+		mapper:      mapper,
+		genfilesDir: genfilesDir,
+		lines:       map[string][]int{},
+	}
+}
@@ -0,0 +1,85 @@
+package coverage
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func newTestConverter(t *testing.T) *Converter {
+	ws, err := filepath.Abs(filepath.Join("testdata", "ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &conf.GobazelConf{
+		GoPkgPrefix: "p.com",
+		Vendors:     []string{"third_party"},
+	}
+	return NewConverter(pathmap.New(cfg, ws, "/gopath/src"), filepath.Join("testdata", "gen"))
+}
+
+func TestConvert(t *testing.T) {
+	in, err := os.Open(filepath.Join("testdata", "coverage.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	lcov, profile := bytes.Buffer{}, bytes.Buffer{}
+	if err := newTestConverter(t).Convert(in, &lcov, &profile); err != nil {
+		t.Fatal(err)
+	}
+
+	for golden, got := range map[string][]byte{
+		"lcov.info":    lcov.Bytes(),
+		"coverage.out": profile.Bytes(),
+	} {
+		golden = filepath.Join("testdata", golden)
+		if *update {
+			if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is\n%s\nwant\n%s", golden, got, want)
+		}
+	}
+}
+
+func TestSourceRel(t *testing.T) {
+	c := newTestConverter(t)
+	for _, tc := range []struct {
+		sf, want string
+		ok       bool
+	}{
+		// Source files in the workspace, then in the generated files.
+		{"a/a.go", "a/a.go", true},
+		{"/x/execroot/__main__/a/a.go", "a/a.go", true},
+		{"a/a.pb.go", "a/a.pb.go", true},
+		{"bazel-out/k8-fastbuild/bin/a/a.pb.go", "a/a.pb.go", true},
+		// Then import paths.
+		{"github.com/x/x.go", "third_party/github.com/x/x.go", true},
+		{"p.com/a/a.go", "a/a.go", true},
+		{"p.com/b/b.go", "b/b.go", true},
+		// Else workspace relative.
+		{"b/b.go", "b/b.go", true},
+		{"/usr/lib/go/src/fmt/print.go", "", false},
+	} {
+		got, ok := c.sourceRel(tc.sf)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("sourceRel(%q) = %q, %v, want %q, %v", tc.sf, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+package a
+
+func (m *Msg) Reset() { *m = Msg{} }
@@ -0,0 +1,5 @@
+package x
+
+func X() int {
+	return 1
+}
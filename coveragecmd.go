@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/coverage"
+	"github.com/linuxerwang/gobazel/exec"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+// coverageCmd runs "bazel coverage" for the given targets or Go package
+// patterns and maps the LCOV report into the virtual GOPATH.
+func coverageCmd(cfg *conf.GobazelConf, args []string) {
+	// The flags are mixed with bazel flags, take out gobazel's own ones.
+	lcovFile, args := takeFlag(args, "lcov", filepath.Join(dirs.StateDir, "lcov.info"))
+	profileFile, args := takeFlag(args, "coverprofile", filepath.Join(dirs.StateDir, "coverage.out"))
+
+	bzlFlags, patterns, _, err := splitGoCmdArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+
+	targets, err := goPatternTargets(cfg, "test", patterns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(targets) == 0 {
+		fmt.Fprintf(os.Stderr, "No go_test targets matched %v.\n", patterns)
+		os.Exit(1)
+	}
+
+	bzlArgs := append([]string{"coverage", "--combined_report=lcov"}, bzlFlags...)
+	start := time.Now()
+	bzlErr := runBazelFiltered(cfg, append(bzlArgs, targets...), os.Stdout, os.Stderr)
+
+	// Prefer the combined report if this run wrote it, fall back to the
+	// reports of the targets.
+	reports := []string{filepath.Join(dirs.Workspace, "bazel-out", "_coverage", "_coverage_report.dat")}
+	if fi, err := os.Stat(reports[0]); bzlErr != nil || err != nil || fi.ModTime().Before(start) {
+		reports = reports[:0]
+		for _, target := range targets {
+			pkg, name := exec.SplitLabel(target)
+			report := filepath.Join(dirs.Workspace, "bazel-testlogs", pkg, name, "coverage.dat")
+			if _, err := os.Stat(report); err == nil {
+				reports = append(reports, report)
+			}
+		}
+	}
+	if len(reports) == 0 {
+		fmt.Fprintln(os.Stderr, "No coverage report found.")
+		exitWith(bzlErr)
+		os.Exit(1)
+	}
+
+	if err := writeCoverage(cfg, reports, lcovFile, profileFile); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to convert coverage report,", err)
+		os.Exit(2)
+	}
+	fmt.Printf("Wrote coverage to %s and %s.\n", lcovFile, profileFile)
+	exitWith(bzlErr)
+}
+
+func writeCoverage(cfg *conf.GobazelConf, reports []string, lcovFile, profileFile string) error {
+	readers := make([]io.Reader, 0, len(reports))
+	for _, report := range reports {
+		f, err := os.Open(report)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	lcov, err := os.Create(lcovFile)
+	if err != nil {
+		return err
+	}
+	defer lcov.Close()
+
+	profile, err := os.Create(profileFile)
+	if err != nil {
+		return err
+	}
+	defer profile.Close()
+
+	conv := coverage.NewConverter(pathmap.New(cfg, dirs.Workspace, dirs.SrcDir), dirs.GenfilesDir)
+	return conv.Convert(io.MultiReader(readers...), lcov, profile)
+}
+
+// takeFlag removes the flag "--name=value" (or "-name=value") from args and
+// returns its value, or def if not given.
+func takeFlag(args []string, name, def string) (string, []string) {
+	value := def
+	rest := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if v := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"); strings.HasPrefix(v, name+"=") {
+			value = v[len(name)+1:]
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return value, rest
+}
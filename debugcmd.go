@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	osexec "os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/delve"
+	"github.com/linuxerwang/gobazel/exec"
+	"github.com/linuxerwang/gobazel/gopathfs"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+func debugConfig(cfg *conf.GobazelConf, args []string) {
+	flags := flag.NewFlagSet("debug-config", flag.ExitOnError)
+	host := flags.String("host", "127.0.0.1", "The host the dlv server listens on.")
+	port := flags.Int("port", 2345, "The port the dlv server listens on.")
+	output := flags.String("output", filepath.Join(dirs.Workspace, ".vscode", "launch.json"), "The launch.json file to update, \"-\" to only print the configuration.")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: gobazel debug-config [options] <bazel-bin path or label>")
+		os.Exit(2)
+	}
+	target := flags.Arg(0)
+
+	binary, err := exec.FindBazelBinary(dirs.Workspace, target)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	lc, rules, err := launchConfig(cfg, target, binary, *host, *port)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	printRules(rules)
+	if err := writeLaunchConfig(*output, lc); err != nil {
+		os.Exit(2)
+	}
+}
+
+// debugRun builds the target with "-c dbg" and runs it with a headless dlv
+// server until either dlv exits or gobazel is stopped.
+func debugRun(cfg *conf.GobazelConf, args []string) {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	host := flags.String("host", "127.0.0.1", "The host the dlv server listens on.")
+	port := flags.Int("port", 2345, "The port the dlv server listens on, 0 to pick a free port.")
+	output := flags.String("output", filepath.Join(dirs.Workspace, ".vscode", "launch.json"), "The launch.json file to update, \"-\" to only print the configuration.")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		fmt.Println("Usage: gobazel debug [options] <bazel label> [-- <args>]")
+		os.Exit(2)
+	}
+	target := flags.Arg(0)
+	binArgs := flags.Args()[1:]
+	if len(binArgs) > 0 && binArgs[0] == "--" {
+		binArgs = binArgs[1:]
+	}
+
+	dlv, err := osexec.LookPath("dlv")
+	if err != nil {
+		fmt.Println("Could not find dlv in PATH,", err)
+		os.Exit(2)
+	}
+
+	// Stream the build output like the bazel wrapper does.
+	if err := runBazelFiltered(cfg, []string{"build", "-c", "dbg", target}, os.Stdout, os.Stderr); err != nil {
+		exitWith(err)
+	}
+
+	binary, err := exec.FindBazelBinary(dirs.Workspace, target)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if *port == 0 {
+		if *port, err = freePort(*host); err != nil {
+			fmt.Println("Failed to find a free port,", err)
+			os.Exit(2)
+		}
+	}
+
+	lc, rules, err := launchConfig(cfg, target, binary, *host, *port)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if err := writeLaunchConfig(*output, lc); err != nil {
+		os.Exit(2)
+	}
+
+	listen := net.JoinHostPort(*host, strconv.Itoa(*port))
+	dlvArgs := []string{"exec", "--headless", "--api-version=2", "--accept-multiclient", "--listen=" + listen, binary}
+	if len(binArgs) > 0 {
+		dlvArgs = append(append(dlvArgs, "--"), binArgs...)
+	}
+	cmd := osexec.Command(dlv, dlvArgs...)
+	cmd.Dir = dirs.Workspace
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = dlvProcAttr()
+	if err := cmd.Start(); err != nil {
+		fmt.Println("Failed to start dlv,", err)
+		os.Exit(2)
+	}
+
+	pidFile := filepath.Join(dirs.Workspace, gobzlDlvPidFile)
+	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d", cmd.Process.Pid)), 0644); err != nil {
+		fmt.Printf("Failed to write to file %s: %v\n", gobzlDlvPidFile, err)
+	}
+	defer os.Remove(pidFile)
+
+	// Stop dlv together with gobazel.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		sig := <-c
+		fmt.Printf("\nStopping dlv (%v).\n", sig)
+		cmd.Process.Signal(syscall.SIGTERM)
+	}()
+
+	fmt.Printf("\ndlv is serving %s on %s.\n", binary, listen)
+	fmt.Printf("Attach from the command line with \"dlv connect %s\" and the substitute-path rules below,\n", listen)
+	fmt.Printf("or from VS Code with the debug configuration \"%s\".\n\n", lc.Name)
+	printRules(rules)
+
+	if err := cmd.Wait(); err != nil {
+		fmt.Println("dlv exited,", err)
+	}
+}
+
+func printRules(rules []delve.Rule) {
+	fmt.Println("Delve substitute-path rules:")
+	for _, r := range rules {
+		fmt.Printf("    config substitute-path %q %q\n", r.Remote, r.Local)
+	}
+}
+
+func writeLaunchConfig(output string, lc *delve.LaunchConfig) error {
+	if output == "-" {
+		b, _ := json.MarshalIndent(lc, "", "    ")
+		fmt.Println(string(b))
+		return nil
+	}
+
+	if err := delve.WriteLaunchConfig(output, lc); err != nil {
+		fmt.Printf("Failed to update %s, %v.\n", output, err)
+		return err
+	}
+	fmt.Printf("Wrote debug configuration \"%s\" to %s.\n", lc.Name, output)
+	return nil
+}
+
+func freePort(host string) (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func launchConfig(cfg *conf.GobazelConf, target, binary, host string, port int) (*delve.LaunchConfig, []delve.Rule, error) {
+	b, err := delve.ReadBinary(binary)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sdkDir, _ := gopathfs.FindGoSDKDir(dirs.Workspace)
+	rules := delve.SubstituteRules(cfg, pathmap.New(cfg, dirs.Workspace, dirs.SrcDir), b, sdkDir)
+	lc := delve.NewLaunchConfig("gobazel: "+target, delve.ExecRoot(b), host, port, rules)
+	return lc, rules, nil
+}
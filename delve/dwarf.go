@@ -0,0 +1,104 @@
+package delve
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"debug/macho"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// CompileUnit describes a Go package compiled into a binary.
+type CompileUnit struct {
+	ImportPath string
+	// Dirs are the directories of the package's source files, as delve
+	// sees them (relative paths are joined with the compilation directory).
+	Dirs []string
+}
+
+// Binary holds the source path information extracted from the DWARF of a
+// Go binary.
+type Binary struct {
+	CompDir string
+	Units   []*CompileUnit
+}
+
+// ReadBinary reads the compilation directory and the source file paths of
+// all compile units from the DWARF of the given binary.
+func ReadBinary(binary string) (*Binary, error) {
+	d, err := openDwarf(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	b := Binary{}
+	r := d.Reader()
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DWARF of %s, %v", binary, err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		compDir, _ := entry.Val(dwarf.AttrCompDir).(string)
+		if b.CompDir == "" && compDir != "" && compDir != "." {
+			b.CompDir = compDir
+		}
+
+		lr, err := d.LineReader(entry)
+		if err != nil || lr == nil {
+			r.SkipChildren()
+			continue
+		}
+
+		cu := CompileUnit{ImportPath: name}
+		seen := map[string]struct{}{}
+		for _, f := range lr.Files() {
+			if f == nil || f.Name == "" || strings.HasPrefix(f.Name, "<") {
+				continue
+			}
+			fname := f.Name
+			if !filepath.IsAbs(fname) && compDir != "" && compDir != "." {
+				fname = filepath.Join(compDir, fname)
+			}
+			dir := filepath.Dir(fname)
+			if dir == "." {
+				continue
+			}
+			if _, ok := seen[dir]; ok {
+				continue
+			}
+			seen[dir] = struct{}{}
+			cu.Dirs = append(cu.Dirs, dir)
+		}
+		if len(cu.Dirs) > 0 {
+			b.Units = append(b.Units, &cu)
+		}
+
+		r.SkipChildren()
+	}
+
+	return &b, nil
+}
+
+func openDwarf(binary string) (*dwarf.Data, error) {
+	if f, err := elf.Open(binary); err == nil {
+		defer f.Close()
+		return f.DWARF()
+	}
+
+	if f, err := macho.Open(binary); err == nil {
+		defer f.Close()
+		return f.DWARF()
+	}
+
+	return nil, fmt.Errorf("%s is neither an ELF nor a Mach-O binary", binary)
+}
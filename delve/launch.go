@@ -0,0 +1,105 @@
+package delve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SubstitutePath is a VS Code substitutePath entry. From is the local path
+// and To is the path in the binary.
+type SubstitutePath struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// LaunchConfig is a VS Code launch configuration attaching to a headless
+// dlv server.
+type LaunchConfig struct {
+	Name           string           `json:"name"`
+	Type           string           `json:"type"`
+	Request        string           `json:"request"`
+	Mode           string           `json:"mode"`
+	RemotePath     string           `json:"remotePath,omitempty"`
+	Host           string           `json:"host"`
+	Port           int              `json:"port"`
+	SubstitutePath []SubstitutePath `json:"substitutePath"`
+}
+
+// NewLaunchConfig returns a launch configuration for the given dlv server
+// and substitution rules.
+func NewLaunchConfig(name, remotePath, host string, port int, rules []Rule) *LaunchConfig {
+	lc := LaunchConfig{
+		Name:           name,
+		Type:           "go",
+		Request:        "attach",
+		Mode:           "remote",
+		RemotePath:     remotePath,
+		Host:           host,
+		Port:           port,
+		SubstitutePath: make([]SubstitutePath, 0, len(rules)),
+	}
+	for _, r := range rules {
+		lc.SubstitutePath = append(lc.SubstitutePath, SubstitutePath{From: r.Local, To: r.Remote})
+	}
+	return &lc
+}
+
+// WriteLaunchConfig adds the configuration to the given launch.json file,
+// replacing any existing configuration with the same name.
+func WriteLaunchConfig(file string, lc *LaunchConfig) error {
+	launch := map[string]json.RawMessage{}
+	if b, err := ioutil.ReadFile(file); err == nil {
+		if err := json.Unmarshal(b, &launch); err != nil {
+			return fmt.Errorf("failed to parse %s (comments are not supported), %v", file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, ok := launch["version"]; !ok {
+		launch["version"] = json.RawMessage(`"0.2.0"`)
+	}
+
+	configs := []json.RawMessage{}
+	if raw, ok := launch["configurations"]; ok {
+		if err := json.Unmarshal(raw, &configs); err != nil {
+			return fmt.Errorf("invalid configurations in %s, %v", file, err)
+		}
+	}
+
+	b, err := json.Marshal(lc)
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i, raw := range configs {
+		c := struct {
+			Name string `json:"name"`
+		}{}
+		if json.Unmarshal(raw, &c) == nil && c.Name == lc.Name {
+			configs[i] = b
+			replaced = true
+		}
+	}
+	if !replaced {
+		configs = append(configs, b)
+	}
+
+	if launch["configurations"], err = json.Marshal(configs); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(launch, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(out, '\n'), 0644)
+}
@@ -0,0 +1,196 @@
+package delve
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+var (
+	execRootRe = regexp.MustCompile(`^(.*/execroot/[^/]+)(/(.*))?$`)
+	genDirRe   = regexp.MustCompile(`^bazel-out/[^/]+/(bin|genfiles)`)
+)
+
+// Rule maps a source path prefix recorded in the binary (Remote) to its
+// location in the virtual GOPATH (Local).
+type Rule struct {
+	Remote string
+	Local  string
+}
+
+type ruleBuilder struct {
+	cfg     *conf.GobazelConf
+	mapper  *pathmap.Mapper
+	compDir string
+	rules   map[string]string
+}
+
+// SubstituteRules derives the path substitution rules which map the
+// execroot (or sandbox) directories, the external repositories and the
+// GOROOT recorded in the binary to the virtual GOPATH. If known, goSDKDir
+// is the go-sdk in bazel external folder. More specific rules come first.
+func SubstituteRules(cfg *conf.GobazelConf, mapper *pathmap.Mapper, b *Binary, goSDKDir string) []Rule {
+	rb := ruleBuilder{
+		cfg:     cfg,
+		mapper:  mapper,
+		compDir: b.CompDir,
+		rules:   map[string]string{},
+	}
+
+	if goSDKDir != "" {
+		rb.addRule(goSDKDir, mapper.GoRoot())
+	}
+
+	for _, cu := range b.Units {
+		if cu.ImportPath == "main" {
+			// The import path of main packages says nothing about their
+			// location, the execroot rules cover them.
+			for _, dir := range cu.Dirs {
+				if root, _, ok := rb.splitExecRoot(dir); ok {
+					rb.addRoot(root)
+				}
+			}
+			continue
+		}
+
+		for _, dir := range cu.Dirs {
+			rb.add(cu.ImportPath, dir)
+		}
+	}
+
+	rules := make([]Rule, 0, len(rb.rules))
+	for remote, local := range rb.rules {
+		rules = append(rules, Rule{Remote: remote, Local: local})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].Remote) != len(rules[j].Remote) {
+			return len(rules[i].Remote) > len(rules[j].Remote)
+		}
+		return rules[i].Remote < rules[j].Remote
+	})
+	return rules
+}
+
+// ExecRoot returns the execroot the binary was compiled in, if any.
+func ExecRoot(b *Binary) string {
+	if m := execRootRe.FindStringSubmatch(b.CompDir); m != nil {
+		return m[1]
+	}
+	for _, cu := range b.Units {
+		for _, dir := range cu.Dirs {
+			if m := execRootRe.FindStringSubmatch(dir); m != nil {
+				return m[1]
+			}
+		}
+	}
+	return b.CompDir
+}
+
+func (rb *ruleBuilder) add(importPath, dir string) {
+	root, rel, ok := rb.splitExecRoot(dir)
+	if !ok {
+		// Outside of the execroot only the Go SDK can be mapped.
+		if isStdPkg(importPath) {
+			rb.addGoRoot(importPath, dir)
+		}
+		return
+	}
+
+	rb.addRoot(root)
+
+	switch {
+	case rel == "GOROOT" || strings.HasPrefix(rel, "GOROOT/"):
+	case strings.HasPrefix(rel, "external/go_sdk/"):
+	case strings.HasPrefix(rel, "external/"):
+		rb.addExternal(importPath, root, rel)
+	default:
+		if gen := genDirRe.FindString(rel); gen != "" {
+			rb.addGenDir(filepath.Join(root, gen))
+		}
+	}
+}
+
+func (rb *ruleBuilder) splitExecRoot(dir string) (root, rel string, ok bool) {
+	if m := execRootRe.FindStringSubmatch(dir); m != nil {
+		return m[1], m[3], true
+	}
+
+	if rb.compDir != "" && filepath.IsAbs(rb.compDir) {
+		if dir == rb.compDir {
+			return rb.compDir, "", true
+		}
+		if strings.HasPrefix(dir, rb.compDir+"/") {
+			return rb.compDir, dir[len(rb.compDir)+1:], true
+		}
+	}
+
+	// Paths trimmed by the compiler are relative to the execroot.
+	if !filepath.IsAbs(dir) {
+		return "", dir, true
+	}
+
+	return "", "", false
+}
+
+func (rb *ruleBuilder) addRoot(root string) {
+	// Relative to an unknown root, the workspace and vendor rules would
+	// match every path, resp. any directory named like a vendor directory.
+	if root != "" {
+		rb.addRule(root, rb.mapper.Virtual(""))
+		for _, vendor := range rb.cfg.Vendors {
+			rb.addRule(filepath.Join(root, vendor), rb.mapper.Virtual(vendor))
+		}
+	}
+	rb.addRule(filepath.Join(root, "external", "go_sdk"), rb.mapper.GoRoot())
+	rb.addRule(filepath.Join(root, "GOROOT"), rb.mapper.GoRoot())
+}
+
+func (rb *ruleBuilder) addGenDir(gen string) {
+	rb.addRule(gen, rb.mapper.Virtual(""))
+	for _, vendor := range rb.cfg.Vendors {
+		rb.addRule(filepath.Join(gen, vendor), rb.mapper.Virtual(vendor))
+	}
+}
+
+func (rb *ruleBuilder) addExternal(importPath, root, rel string) {
+	// rel is external/<repo>[/<pkg dir>].
+	parts := strings.SplitN(rel, "/", 3)
+	if len(parts) < 2 {
+		return
+	}
+	repoDir := filepath.Join(root, parts[0], parts[1])
+	if len(parts) == 2 {
+		rb.addRule(repoDir, filepath.Join(rb.mapper.SrcDir(), importPath))
+		return
+	}
+
+	// The repository root import path is the import path without the
+	// package directory inside the repository.
+	if sub := parts[2]; strings.HasSuffix(importPath, "/"+sub) {
+		rb.addRule(repoDir, filepath.Join(rb.mapper.SrcDir(), importPath[:len(importPath)-len(sub)-1]))
+		return
+	}
+	rb.addRule(filepath.Join(root, rel), filepath.Join(rb.mapper.SrcDir(), importPath))
+}
+
+func (rb *ruleBuilder) addGoRoot(importPath, dir string) {
+	suffix := "/src/" + importPath
+	if strings.HasSuffix(dir, suffix) {
+		rb.addRule(dir[:len(dir)-len(suffix)], rb.mapper.GoRoot())
+	}
+}
+
+func (rb *ruleBuilder) addRule(remote, local string) {
+	if _, ok := rb.rules[remote]; !ok {
+		rb.rules[remote] = local
+	}
+}
+
+func isStdPkg(importPath string) bool {
+	first := strings.SplitN(importPath, "/", 2)[0]
+	return first != "" && !strings.Contains(first, ".")
+}
@@ -0,0 +1,127 @@
+package delve
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+const (
+	testExecRoot = "/home/u/.cache/bazel/_bazel_u/0123/execroot/__main__"
+	testSandbox  = "/home/u/.cache/bazel/_bazel_u/0123/sandbox/linux-sandbox/7/execroot/__main__"
+)
+
+func newTestRuleBuilder(compDir string) *ruleBuilder {
+	cfg := &conf.GobazelConf{
+		GoPkgPrefix: "p.com",
+		Vendors:     []string{"third_party"},
+	}
+	return &ruleBuilder{
+		cfg:     cfg,
+		mapper:  pathmap.New(cfg, "/ws", "/gopath/src"),
+		compDir: compDir,
+		rules:   map[string]string{},
+	}
+}
+
+func TestSplitExecRoot(t *testing.T) {
+	for _, tc := range []struct {
+		compDir, dir string
+		root, rel    string
+		ok           bool
+	}{
+		{testExecRoot, testExecRoot + "/a/b", testExecRoot, "a/b", true},
+		{testExecRoot, testExecRoot, testExecRoot, "", true},
+		{testExecRoot, testSandbox + "/a", testSandbox, "a", true},
+		{"/build", "/build/a/b", "/build", "a/b", true},
+		{"/build", "/build", "/build", "", true},
+		{"/build", "/buildx/a", "", "", false},
+		// Trimmed paths are relative to an unknown execroot.
+		{"", "a/b", "", "a/b", true},
+		{".", "external/repo/pkg", "", "external/repo/pkg", true},
+		{"", "/usr/local/go/src/fmt", "", "", false},
+	} {
+		rb := newTestRuleBuilder(tc.compDir)
+		root, rel, ok := rb.splitExecRoot(tc.dir)
+		if root != tc.root || rel != tc.rel || ok != tc.ok {
+			t.Errorf("splitExecRoot(%q) with comp_dir %q = %q, %q, %v, want %q, %q, %v",
+				tc.dir, tc.compDir, root, rel, ok, tc.root, tc.rel, tc.ok)
+		}
+	}
+}
+
+func TestSubstituteRules(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		bin  *Binary
+		want []Rule
+	}{
+		{
+			name: "execroot",
+			bin: &Binary{
+				CompDir: testExecRoot,
+				Units: []*CompileUnit{
+					{ImportPath: "main", Dirs: []string{testExecRoot + "/cmd/app"}},
+					{ImportPath: "p.com/a", Dirs: []string{testExecRoot + "/a"}},
+					{ImportPath: "p.com/gen", Dirs: []string{testExecRoot + "/bazel-out/k8-fastbuild/bin/gen"}},
+					{ImportPath: "github.com/x/y", Dirs: []string{testExecRoot + "/third_party/github.com/x/y"}},
+					{ImportPath: "github.com/z/w/sub", Dirs: []string{testExecRoot + "/external/com_github_z_w/sub"}},
+					{ImportPath: "fmt", Dirs: []string{"/usr/local/go/src/fmt"}},
+				},
+			},
+			want: []Rule{
+				{testExecRoot + "/bazel-out/k8-fastbuild/bin/third_party", "/gopath/src"},
+				{testExecRoot + "/bazel-out/k8-fastbuild/bin", "/gopath/src/p.com"},
+				{testExecRoot + "/external/com_github_z_w", "/gopath/src/github.com/z/w"},
+				{testExecRoot + "/external/go_sdk", "/gopath/src/p.com/GOROOT"},
+				{testExecRoot + "/third_party", "/gopath/src"},
+				{testExecRoot + "/GOROOT", "/gopath/src/p.com/GOROOT"},
+				{testExecRoot, "/gopath/src/p.com"},
+				{"/usr/local/go", "/gopath/src/p.com/GOROOT"},
+			},
+		},
+		{
+			name: "sandbox",
+			bin: &Binary{
+				CompDir: testSandbox,
+				Units: []*CompileUnit{
+					{ImportPath: "p.com/a", Dirs: []string{testSandbox + "/a"}},
+				},
+			},
+			want: []Rule{
+				{testSandbox + "/external/go_sdk", "/gopath/src/p.com/GOROOT"},
+				{testSandbox + "/third_party", "/gopath/src"},
+				{testSandbox + "/GOROOT", "/gopath/src/p.com/GOROOT"},
+				{testSandbox, "/gopath/src/p.com"},
+			},
+		},
+		{
+			name: "trimmed",
+			bin: &Binary{
+				CompDir: ".",
+				Units: []*CompileUnit{
+					{ImportPath: "main", Dirs: []string{"cmd/app"}},
+					{ImportPath: "p.com/a", Dirs: []string{"a"}},
+					{ImportPath: "p.com/gen", Dirs: []string{"bazel-out/k8-fastbuild/bin/gen"}},
+					{ImportPath: "github.com/z/w", Dirs: []string{"external/com_github_z_w"}},
+				},
+			},
+			// No rules for "" or "third_party", they would match anything.
+			want: []Rule{
+				{"bazel-out/k8-fastbuild/bin/third_party", "/gopath/src"},
+				{"bazel-out/k8-fastbuild/bin", "/gopath/src/p.com"},
+				{"external/com_github_z_w", "/gopath/src/github.com/z/w"},
+				{"external/go_sdk", "/gopath/src/p.com/GOROOT"},
+				{"GOROOT", "/gopath/src/p.com/GOROOT"},
+			},
+		},
+	} {
+		rb := newTestRuleBuilder(tc.bin.CompDir)
+		got := SubstituteRules(rb.cfg, rb.mapper, tc.bin, "")
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: SubstituteRules() =\n%v\nwant\n%v", tc.name, got, tc.want)
+		}
+	}
+}
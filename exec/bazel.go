@@ -0,0 +1,327 @@
+package exec
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/linuxerwang/gobazel/bep"
+	"github.com/linuxerwang/gobazel/conf"
+)
+
+const (
+	busyPollInterval = 2 * time.Second
+)
+
+// Bazel runs the bazel commands gobazel starts on its own, e.g., the builds
+// triggered by file changes. With a dedicated output base they run in their
+// own bazel server and don't block the user's bazel commands.
+type Bazel struct {
+	workspace     string
+	stateDir      string
+	outputBase    string
+	diskCache     string
+	symlinkPrefix string
+	status        *bep.Recorder
+	cache         *QueryCache
+
+	mu      sync.Mutex
+	running int
+	onIdle  []func()
+}
+
+// OnBuildsDone registers f to be called whenever the last running build
+// command of this Bazel finishes.
+func (b *Bazel) OnBuildsDone(f func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onIdle = append(b.onIdle, f)
+}
+
+// started tracks the running build commands and returns the function to
+// call when the command finishes.
+func (b *Bazel) started(args []string) func() {
+	if len(args) == 0 {
+		return func() {}
+	}
+	switch args[0] {
+	case "build", "test", "run", "coverage":
+	default:
+		return func() {}
+	}
+
+	b.mu.Lock()
+	b.running++
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		b.running--
+		idle := b.running == 0
+		fs := b.onIdle
+		b.mu.Unlock()
+
+		if idle {
+			for _, f := range fs {
+				f()
+			}
+		}
+	}
+}
+
+// Argv returns the command line of the given bazel command and arguments,
+// with the dedicated output base and disk cache options.
+func (b *Bazel) Argv(args []string) []string {
+	return b.argv(args)
+}
+
+// argv is Argv with extra flags for build commands.
+func (b *Bazel) argv(args []string, flags ...string) []string {
+	argv := []string{"bazel"}
+	if b.outputBase != "" {
+		argv = append(argv, "--output_base="+b.outputBase)
+	}
+	if len(args) == 0 {
+		return argv
+	}
+
+	argv = append(argv, args[0])
+	switch args[0] {
+	case "build", "test", "run", "coverage":
+		if b.diskCache != "" {
+			argv = append(argv, "--disk_cache="+b.diskCache)
+		}
+		if b.symlinkPrefix != "" {
+			// Don't touch the user's convenience symlinks.
+			argv = append(argv, "--symlink_prefix="+b.symlinkPrefix)
+		}
+		argv = append(argv, flags...)
+	}
+	return append(argv, args[1:]...)
+}
+
+// Run executes the given bazel command and arguments in the workspace, and
+// returns the combined output. The results of builds are recorded in the
+// build status file.
+func (b *Bazel) Run(ctx context.Context, cfg *conf.GobazelConf, args []string) ([]byte, error) {
+	defer b.started(args)()
+
+	eventFile, flags := b.buildEventFile(args)
+	argv := b.argv(args, flags...)
+	out, err := RunCommandContext(ctx, cfg, b.workspace, argv)
+	b.record(ctx, argv, eventFile)
+	return out, err
+}
+
+// Build executes one "bazel build" for the given bazel build targets, with
+// optional extra build flags. The build is canceled when ctx is done. If
+// the build status is recorded, the build's results are returned.
+func (b *Bazel) Build(ctx context.Context, targets []string, flags ...string) (*bep.Build, error) {
+	args := append(append([]string{"build"}, flags...), targets...)
+	defer b.started(args)()
+
+	eventFile, bepFlags := b.buildEventFile(args)
+	argv := b.argv(args, bepFlags...)
+
+	display := strings.Join(argv, " ")
+	if len(targets) > 1 {
+		display = fmt.Sprintf("%s (%d targets)", strings.Join(argv[:len(argv)-len(targets)], " "), len(targets))
+	}
+	err := runBazelBuild(ctx, b.workspace, argv, display)
+	return b.record(ctx, argv, eventFile), err
+}
+
+// buildEventFile returns a new file for the build events of the bazel
+// command and the flags to write it, if the build status is recorded.
+func (b *Bazel) buildEventFile(args []string) (string, []string) {
+	if b.status == nil || len(args) == 0 {
+		return "", nil
+	}
+	switch args[0] {
+	case "build", "test", "run", "coverage":
+	default:
+		return "", nil
+	}
+
+	f, err := ioutil.TempFile(b.stateDir, "bep-*.json")
+	if err != nil {
+		return "", nil
+	}
+	f.Close()
+	return f.Name(), []string{"--build_event_json_file=" + f.Name()}
+}
+
+func (b *Bazel) record(ctx context.Context, argv []string, eventFile string) *bep.Build {
+	if eventFile == "" {
+		return nil
+	}
+	defer os.Remove(eventFile)
+
+	if ctx.Err() != nil {
+		// Canceled builds are superseded by newer ones.
+		return nil
+	}
+	build, err := b.status.Record(strings.Join(argv, " "), eventFile)
+	if err != nil {
+		fmt.Printf("Failed to record the build status, %v.\n", err)
+	}
+	return build
+}
+
+// Query executes "bazel query" with the given expression and returns the
+// resulting targets. If parts of the workspace failed to load, the targets
+// found in the rest are returned along with the error, and the caller
+// decides whether they're good enough.
+func (b *Bazel) Query(ctx context.Context, expr string) ([]string, error) {
+	targets, key, ok := b.cache.Get(expr)
+	if ok {
+		return targets, nil
+	}
+
+	argv := b.Argv([]string{"query", "--keep_going", expr})
+	cmd := commandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = b.workspace
+	out, err := cmd.Output()
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+
+	targets = parseTargets(out)
+	if err == nil {
+		// Partial results aren't cached.
+		b.cache.Put(key, expr, targets)
+	}
+	return targets, err
+}
+
+// InvalidateQueries handles the event kind (create, write, remove or
+// rename) of the workspace relative path for the query cache.
+func (b *Bazel) InvalidateQueries(kind, path string) {
+	b.cache.Invalidate(kind, path)
+}
+
+// TrackQueries marks the query cache as kept up to date with
+// InvalidateQueries, so that other gobazel commands can use it right away.
+func (b *Bazel) TrackQueries() {
+	b.cache.Track()
+}
+
+// ResetQueries drops all results of the query cache.
+func (b *Bazel) ResetQueries() {
+	b.cache.Reset()
+}
+
+// GenfilesDir returns the directory of the generated files.
+func (b *Bazel) GenfilesDir() string {
+	if b.symlinkPrefix != "" {
+		return b.symlinkPrefix + "genfiles"
+	}
+	return filepath.Join(b.workspace, "bazel-genfiles")
+}
+
+// Busy reports whether the user's bazel server is running a command, i.e.,
+// a bazel client holds the lock of the workspace's output base.
+func (b *Bazel) Busy() bool {
+	outputBase, ok := UserOutputBase(b.workspace)
+	if !ok {
+		return false
+	}
+
+	f, err := os.OpenFile(filepath.Join(outputBase, "lock"), os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lock); err != nil {
+		return false
+	}
+	return lock.Type != syscall.F_UNLCK
+}
+
+// WaitIdle defers background work until the user's bazel server isn't
+// busy, or ctx is done.
+func (b *Bazel) WaitIdle(ctx context.Context) error {
+	if !b.Busy() {
+		return nil
+	}
+
+	fmt.Println("The bazel server is busy, background builds are deferred.")
+	ticker := time.NewTicker(busyPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if !b.Busy() {
+				return nil
+			}
+		}
+	}
+}
+
+// UserOutputBase returns the output base of the user's bazel server, found
+// through the "bazel-out" symbolic link in the given workspace, or at the
+// default location before the first build.
+func UserOutputBase(workspace string) (string, bool) {
+	target, err := os.Readlink(filepath.Join(workspace, "bazel-out"))
+	if err != nil {
+		return defaultOutputBase(workspace)
+	}
+
+	// The link points to <output_base>/execroot/<workspace name>/bazel-out.
+	idx := strings.LastIndex(target, string(os.PathSeparator)+"execroot"+string(os.PathSeparator))
+	if idx < 0 {
+		return defaultOutputBase(workspace)
+	}
+	return target[:idx], true
+}
+
+// defaultOutputBase returns the output base bazel uses for the workspace
+// without --output_user_root or --output_base, if it exists.
+func defaultOutputBase(workspace string) (string, bool) {
+	u, err := user.Current()
+	if err != nil {
+		return "", false
+	}
+	if real, err := filepath.EvalSymlinks(workspace); err == nil {
+		workspace = real
+	}
+	sum := md5.Sum([]byte(workspace))
+	outputBase := filepath.Join(defaultOutputUserRoot(u.Username), hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(filepath.Join(outputBase, "lock")); err != nil {
+		return "", false
+	}
+	return outputBase, true
+}
+
+// NewBazel returns a new Bazel for the workspace. Without a dedicated output
+// base in the config, the user's bazel server is used. If status isn't nil,
+// the results of builds are recorded with it.
+func NewBazel(cfg *conf.GobazelConf, workspace, stateDir string, status *bep.Recorder) *Bazel {
+	b := Bazel{
+		workspace: workspace,
+		stateDir:  stateDir,
+		status:    status,
+		cache:     NewQueryCache(workspace, stateDir),
+	}
+	if cfg.Bazel != nil {
+		b.outputBase = cfg.Bazel.OutputBase
+		b.diskCache = cfg.Bazel.DiskCache
+		if b.outputBase != "" {
+			// A separate server doesn't hold up the user's bazel commands.
+			b.symlinkPrefix = filepath.Join(stateDir, "bazel-")
+		}
+	}
+	return &b
+}
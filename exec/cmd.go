@@ -1,76 +1,287 @@
 package exec
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/linuxerwang/gobazel/conf"
 )
 
-// RunGoInstall executes the "go install" command on the given Go package.
-func RunGoInstall(cfg *conf.GobazelConf, goPkg string) {
-	cmd := fmt.Sprintf("go install %s", goPkg)
-	fmt.Print(cmd)
-	if err := RunCommand(cfg, cmd); err != nil {
-		fmt.Println(" (failed!)")
-	} else {
-		fmt.Println(" (done)")
+const (
+	// interruptGrace is how long a canceled command may take to exit after
+	// being interrupted, before it's killed.
+	interruptGrace = 10 * time.Second
+)
+
+func goInstall(ctx context.Context, cfg *conf.GobazelConf, goPkg string) ([]byte, error) {
+	cmd := commandContext(ctx, "go", "install", goPkg)
+	cmd.Env = replaceGoPath(cfg)
+	return cmd.CombinedOutput()
+}
+
+type installResult struct {
+	pkg string
+	out []byte
+	err error
+}
+
+// RunGoWalkInstall walks the given project directories and runs "go install"
+// for each Go package, see RunGoInstalls.
+func RunGoWalkInstall(ctx context.Context, cfg *conf.GobazelConf, workspace string, projs []string) error {
+	pkgs := []string{}
+	for _, proj := range projs {
+		pkgs = append(pkgs, findGoPackages(cfg, workspace, proj)...)
+	}
+	return RunGoInstalls(ctx, cfg, pkgs)
+}
+
+// RunGoInstalls runs "go install" for the given Go packages, a bounded
+// number of them in parallel. It prints a summary of the failed packages,
+// and returns an error if any failed.
+func RunGoInstalls(ctx context.Context, cfg *conf.GobazelConf, pkgs []string) error {
+	pkgCh := make(chan string)
+	resCh := make(chan installResult)
+	wg := sync.WaitGroup{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range pkgCh {
+				out, err := goInstall(ctx, cfg, pkg)
+				resCh <- installResult{pkg: pkg, out: out, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(pkgCh)
+		for _, pkg := range pkgs {
+			select {
+			case pkgCh <- pkg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(resCh)
+	}()
+
+	installed := 0
+	failed := []installResult{}
+	for res := range resCh {
+		switch {
+		case ctx.Err() != nil:
+		case res.err != nil && bytes.Contains(res.out, []byte("no non-test Go files")):
+			// E.g., a BUILD file for tests only.
+		case res.err != nil && bytes.Contains(res.out, []byte("no Go files")):
+			// E.g., a BUILD file for other languages.
+		case res.err != nil:
+			fmt.Printf("go install %s (failed!)\n", res.pkg)
+			failed = append(failed, res)
+		default:
+			fmt.Printf("go install %s (done)\n", res.pkg)
+			installed++
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	fmt.Printf("\ngo install summary: %d packages installed, %d failed.\n", installed, len(failed))
+	if len(failed) == 0 {
+		return nil
 	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].pkg < failed[j].pkg })
+	for _, res := range failed {
+		fmt.Printf("--- %s: %v\n%s", res.pkg, res.err, res.out)
+	}
+	return fmt.Errorf("go install failed for %d packages", len(failed))
 }
 
-// RunGoWalkInstall walks the given proj directory and run "go install"
-// for each go package.
-func RunGoWalkInstall(cfg *conf.GobazelConf, workspace, proj string) {
+// findGoPackages returns the import paths of the Go packages in the given
+// project directory, i.e., the directories with .go files or BUILD files.
+// Vendor, ignored and hidden directories are skipped.
+func findGoPackages(cfg *conf.GobazelConf, workspace, proj string) []string {
+	ignoreRegexes := []*regexp.Regexp{}
+	for _, ign := range cfg.Ignores {
+		if re, err := regexp.Compile(ign); err == nil {
+			ignoreRegexes = append(ignoreRegexes, re)
+		}
+	}
+
+	pkgs := []string{}
+	seen := map[string]struct{}{}
 	filepath.Walk(filepath.Join(workspace, proj), func(path string, info os.FileInfo, err error) error {
-		if info.Name() == "BUILD" {
-			if dir, err := filepath.Rel(workspace, path); err == nil {
-				dir = filepath.Dir(dir)
-				for _, v := range cfg.Vendors {
-					if strings.HasPrefix(dir, v) {
-						// Ignore third party Go vendor directories.
-						return nil
-					}
-				}
-
-				RunGoInstall(cfg, filepath.Join(cfg.GoPkgPrefix, dir))
+		if err != nil {
+			// Skip unreadable files and directories.
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(workspace, path)
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() {
+			if skipGoPackageDir(cfg, ignoreRegexes, rel, info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch name := info.Name(); {
+		case name == "BUILD", name == "BUILD.bazel", strings.HasSuffix(name, ".go"):
+			dir := filepath.Dir(rel)
+			if _, ok := seen[dir]; !ok {
+				seen[dir] = struct{}{}
+				pkgs = append(pkgs, filepath.Join(cfg.GoPkgPrefix, dir))
 			}
 		}
 		return nil
 	})
+	return pkgs
+}
+
+func skipGoPackageDir(cfg *conf.GobazelConf, ignoreRegexes []*regexp.Regexp, rel, name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "bazel-") || name == "testdata" {
+		return true
+	}
+	for _, v := range cfg.Vendors {
+		if rel == v || strings.HasPrefix(rel, v+string(os.PathSeparator)) {
+			// Ignore third party Go vendor directories.
+			return true
+		}
+	}
+	for _, re := range ignoreRegexes {
+		if re.MatchString(rel) {
+			return true
+		}
+	}
+	return false
 }
 
-// RunBazelQuery executes "bazel query" for the given folder and returns
-// all bazel build targets under this sub tree.
-func RunBazelQuery(workspace, folder string, command []string, targets map[string]struct{}) {
-	cmd := exec.Command(command[0], command[1:]...)
+// RunBazelQueryTargets executes "bazel query" with the given expression and
+// returns the resulting targets. Results are taken from and stored in the
+// cache, if not nil.
+func RunBazelQueryTargets(workspace, expr string, cache *QueryCache) ([]string, error) {
+	key := ""
+	if cache != nil {
+		targets, k, ok := cache.Get(expr)
+		if ok {
+			return targets, nil
+		}
+		key = k
+	}
+
+	cmd := exec.Command("bazel", "query", expr)
 	cmd.Dir = workspace
-	out, _ := cmd.Output()
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("bazel query %s failed, %v", expr, err)
+	}
+
+	targets := parseTargets(out)
+	if cache != nil {
+		cache.Put(key, expr, targets)
+	}
+	return targets, nil
+}
 
+func parseTargets(out []byte) []string {
+	targets := []string{}
 	for _, line := range strings.Split(string(out), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		if strings.HasPrefix(line, "//"+folder+"/") {
-			targets[line] = struct{}{}
+		if line = strings.TrimSpace(line); line != "" {
+			targets = append(targets, line)
 		}
 	}
+	return targets
 }
 
-// RunBazelBuild executes "bazel build" for the given bazel build target.
-func RunBazelBuild(workspace, target string) {
-	cmd := exec.Command("bazel", "build", target)
+// runBazelBuild runs the bazel build, showing its output only if it fails.
+func runBazelBuild(ctx context.Context, workspace string, argv []string, display string) error {
+	cmd := commandContext(ctx, argv[0], argv[1:]...)
 	cmd.Dir = workspace
 
-	fmt.Printf("bazel build %s", target)
-	if err := cmd.Run(); err != nil {
+	fmt.Print(display)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		fmt.Println(" (canceled)")
+		return ctx.Err()
+	}
+	if err != nil {
 		fmt.Println(" (failed!)")
-	} else {
-		fmt.Println(" (done)")
+		fmt.Print(string(out))
+		return err
 	}
+	fmt.Println(" (done)")
+	return nil
+}
+
+// RunBazelPiped executes bazel with the given arguments in the workspace,
+// writing its output to stdout and stderr.
+func RunBazelPiped(workspace string, args []string, stdout, stderr io.Writer) error {
+	cmd := exec.Command("bazel", args...)
+	cmd.Dir = workspace
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// FindBazelBinary returns the path of the binary built for the given bazel
+// target. If target is an existing file it's returned as is.
+func FindBazelBinary(workspace, target string) (string, error) {
+	if fi, err := os.Stat(target); err == nil && !fi.IsDir() {
+		return target, nil
+	}
+
+	pkg, name := SplitLabel(target)
+	candidates := []string{
+		filepath.Join(workspace, "bazel-bin", pkg, name),
+		filepath.Join(workspace, "bazel-bin", pkg, name+"_", name),
+	}
+	// Older rules_go put binaries in a platform specific folder, e.g.,
+	// linux_amd64_stripped.
+	if matches, err := filepath.Glob(filepath.Join(workspace, "bazel-bin", pkg, "*_*", name)); err == nil {
+		candidates = append(candidates, matches...)
+	}
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && !fi.IsDir() {
+			return c, nil
+		}
+	}
+
+	// Ask bazel as the last resort.
+	cmd := exec.Command("bazel", "cquery", "--output=files", target)
+	cmd.Dir = workspace
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the binary of %s, %v", target, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		return filepath.Join(workspace, line), nil
+	}
+	return "", fmt.Errorf("no binary found for %s", target)
 }
 
 // RunCommand executes the given command.
@@ -81,6 +292,27 @@ func RunCommand(cfg *conf.GobazelConf, command string) error {
 	return cmd.Run()
 }
 
+// RunCommandContext executes the command given as argv in dir, and returns
+// its combined output. The command is interrupted when ctx is done.
+func RunCommandContext(ctx context.Context, cfg *conf.GobazelConf, dir string, argv []string) ([]byte, error) {
+	cmd := commandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = replaceGoPath(cfg)
+	return cmd.CombinedOutput()
+}
+
+// commandContext returns a command which is interrupted when ctx is done.
+// Unlike a killed bazel client, an interrupted one stops the build in the
+// bazel server and releases its lock.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = interruptGrace
+	return cmd
+}
+
 func replaceGoPath(cfg *conf.GobazelConf) []string {
 	environ := []string{fmt.Sprintf("GOPATH=%s", cfg.GoPath)}
 	env := os.Environ()
@@ -92,3 +324,15 @@ func replaceGoPath(cfg *conf.GobazelConf) []string {
 	}
 	return environ
 }
+
+// SplitLabel splits a bazel label into its package and target name. The
+// repository of external labels (@repo//pkg:name) is dropped.
+func SplitLabel(label string) (pkg, name string) {
+	if idx := strings.Index(label, "//"); idx > -1 {
+		label = label[idx+2:]
+	}
+	if idx := strings.Index(label, ":"); idx > -1 {
+		return label[:idx], label[idx+1:]
+	}
+	return label, filepath.Base(label)
+}
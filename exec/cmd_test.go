@@ -0,0 +1,23 @@
+package exec
+
+import (
+	"testing"
+)
+
+func TestSplitLabel(t *testing.T) {
+	for _, tc := range []struct {
+		label, pkg, name string
+	}{
+		{"//a/b:c", "a/b", "c"},
+		{"//a/b", "a/b", "b"},
+		{"//:c", "", "c"},
+		{"a/b:c", "a/b", "c"},
+		{"@repo//a/b:c", "a/b", "c"},
+		{"@@repo~1//a/b", "a/b", "b"},
+	} {
+		pkg, name := SplitLabel(tc.label)
+		if pkg != tc.pkg || name != tc.name {
+			t.Errorf("SplitLabel(%q) = %q, %q, want %q, %q", tc.label, pkg, name, tc.pkg, tc.name)
+		}
+	}
+}
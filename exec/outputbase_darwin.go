@@ -0,0 +1,10 @@
+package exec
+
+import (
+	"path/filepath"
+)
+
+// defaultOutputUserRoot returns bazel's default --output_user_root.
+func defaultOutputUserRoot(user string) string {
+	return filepath.Join("/private/var/tmp", "_bazel_"+user)
+}
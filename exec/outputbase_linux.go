@@ -0,0 +1,12 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// defaultOutputUserRoot returns bazel's default --output_user_root.
+func defaultOutputUserRoot(user string) string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".cache", "bazel", "_bazel_"+user)
+}
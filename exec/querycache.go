@@ -0,0 +1,400 @@
+package exec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	queryCacheDir   = "query-cache"
+	queryCacheIndex = "files.json"
+)
+
+// QueryCache is an on-disk cache of bazel query results. Results are keyed
+// by the query expression and the hashes of the workspace's BUILD, .bzl,
+// WORKSPACE and MODULE files.
+//
+// The hashes are kept in an index file. A gobazel process watching the
+// workspace tracks them with Invalidate, and only rehashes the changed
+// files. While it's running, other processes (e.g., "gobazel test") take the
+// index as is; otherwise they check the files for changes once.
+type QueryCache struct {
+	mu          sync.Mutex
+	dir         string
+	workspace   string
+	tracked     bool
+	fingerprint string
+	index       *queryCacheIndexFile
+}
+
+type queryCacheIndexFile struct {
+	Fingerprint string               `json:"fingerprint"`
+	Files       map[string]*fileHash `json:"files"`
+	// Pid is the process tracking the files, if any.
+	Pid int `json:"pid,omitempty"`
+}
+
+type fileHash struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+}
+
+type queryCacheEntry struct {
+	Expr    string   `json:"expr"`
+	Targets []string `json:"targets"`
+}
+
+var (
+	// The workspace packages a query expression refers to, with "/..." if
+	// recursive.
+	queryPackageRe = regexp.MustCompile(`(^|[^@\w])//([^:\s"'(),+]*)`)
+)
+
+// Get returns the cached results of the query expression. Otherwise, the
+// results can be cached with Put and the returned key.
+func (c *QueryCache) Get(expr string) ([]string, string, bool) {
+	key := c.entryFile(expr)
+	b, err := ioutil.ReadFile(key)
+	if err != nil {
+		return nil, key, false
+	}
+	entry := queryCacheEntry{}
+	if err := json.Unmarshal(b, &entry); err != nil || entry.Expr != expr {
+		return nil, key, false
+	}
+	return entry.Targets, key, true
+}
+
+// Put caches the results of the query expression under the key returned by
+// Get, i.e., for the build files before the query ran.
+func (c *QueryCache) Put(key, expr string, targets []string) {
+	b, err := json.Marshal(&queryCacheEntry{Expr: expr, Targets: targets})
+	if err != nil {
+		return
+	}
+	writeFileAtomic(key, b)
+}
+
+// Track marks the cache as kept up to date with Invalidate, e.g., by a
+// file watcher of the workspace. Other processes use its index then. The
+// files are checked in the background.
+func (c *QueryCache) Track() {
+	c.mu.Lock()
+	c.tracked = true
+	c.fingerprint = ""
+	c.mu.Unlock()
+
+	go c.currentFingerprint()
+}
+
+// Invalidate handles the event kind (create, write, remove or rename) of the
+// workspace relative path. Changed build files change the key of all
+// results. Files created or removed in a package can change the results of
+// its globs, so then the results of queries of the package are dropped.
+// Elsewhere, only added or removed packages matter, which the build files
+// tell.
+func (c *QueryCache) Invalidate(kind, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Created, removed or renamed paths may be directories of build files.
+	if IsBuildFile(path) || kind != "write" {
+		c.update(path)
+	}
+	if kind != "write" {
+		dir := filepath.Dir(path)
+		if dir == "." {
+			dir = ""
+		}
+		if c.isPackage(dir) {
+			c.dropPackage(dir)
+		}
+	}
+}
+
+// Reset drops all results, e.g., when file events were lost.
+func (c *QueryCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The next fingerprint checks all files, other processes don't take
+	// the index until then.
+	c.fingerprint = ""
+	if c.index != nil && c.index.Pid != 0 {
+		c.index.Pid = 0
+		c.writeIndex()
+	}
+	c.clear()
+	if c.tracked {
+		go c.currentFingerprint()
+	}
+}
+
+func (c *QueryCache) entryFile(expr string) string {
+	h := sha256.Sum256([]byte(expr + "\x00" + c.currentFingerprint()))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:16])+".json")
+}
+
+func (c *QueryCache) currentFingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fingerprint == "" {
+		c.fingerprint = c.computeFingerprint()
+	}
+	return c.fingerprint
+}
+
+// must hold c.mu
+func (c *QueryCache) computeFingerprint() string {
+	if c.index == nil {
+		c.index = &queryCacheIndexFile{}
+		if b, err := ioutil.ReadFile(filepath.Join(c.dir, queryCacheIndex)); err == nil {
+			json.Unmarshal(b, c.index)
+		}
+		if c.index.Files == nil {
+			c.index.Files = map[string]*fileHash{}
+		}
+	}
+
+	switch {
+	case c.tracked && c.index.Pid == os.Getpid():
+		// Invalidate updated the files.
+	case !c.tracked && c.index.Pid != 0 && processAlive(c.index.Pid):
+		// The tracking process keeps the index up to date.
+		return c.index.Fingerprint
+	default:
+		c.index.Files = c.scan("", c.index.Files)
+		c.index.Pid = 0
+		if c.tracked {
+			c.index.Pid = os.Getpid()
+		}
+	}
+
+	fingerprint := c.index.fingerprint()
+	// Results of other build files are unlikely to be used again.
+	if fingerprint != c.index.Fingerprint {
+		c.clear()
+	}
+	c.index.Fingerprint = fingerprint
+	c.writeIndex()
+	return fingerprint
+}
+
+// must hold c.mu
+func (c *QueryCache) writeIndex() {
+	if b, err := json.Marshal(c.index); err == nil {
+		writeFileAtomic(filepath.Join(c.dir, queryCacheIndex), b)
+	}
+}
+
+// scan returns the hashes of the build files in the workspace relative
+// directory, only hashing the files changed since old.
+func (c *QueryCache) scan(dir string, old map[string]*fileHash) map[string]*fileHash {
+	files := map[string]*fileHash{}
+	root := filepath.Join(c.workspace, dir)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if path != c.workspace && (strings.HasPrefix(info.Name(), ".") || strings.HasPrefix(info.Name(), "bazel-")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel := path[len(c.workspace)+1:]
+		if !IsBuildFile(rel) {
+			return nil
+		}
+		if fh, ok := old[rel]; ok && fh.Size == info.Size() && fh.ModTime.Equal(info.ModTime()) {
+			files[rel] = fh
+			return nil
+		}
+		if hash, err := hashFile(path); err == nil {
+			files[rel] = &fileHash{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+		}
+		return nil
+	})
+	return files
+}
+
+// update rehashes the build files at the workspace relative path, a file or
+// a directory, after it changed.
+//
+// must hold c.mu
+func (c *QueryCache) update(path string) {
+	if !c.tracked || c.index == nil || c.index.Pid != os.Getpid() {
+		// The next fingerprint checks all files.
+		c.fingerprint = ""
+		return
+	}
+
+	old := map[string]*fileHash{}
+	for rel, fh := range c.index.Files {
+		if rel == path || strings.HasPrefix(rel, path+string(os.PathSeparator)) {
+			old[rel] = fh
+			delete(c.index.Files, rel)
+		}
+	}
+	for rel, fh := range c.scan(path, old) {
+		c.index.Files[rel] = fh
+	}
+	c.fingerprint = ""
+}
+
+// fingerprint hashes the hashes of the files.
+func (idx *queryCacheIndexFile) fingerprint() string {
+	rels := make([]string, 0, len(idx.Files))
+	for rel := range idx.Files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	h := sha256.New()
+	for _, rel := range rels {
+		fmt.Fprintf(h, "%s\x00%s\n", rel, idx.Files[rel].Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isPackage reports whether the workspace relative directory has a BUILD
+// file.
+func (c *QueryCache) isPackage(dir string) bool {
+	for _, build := range []string{"BUILD", "BUILD.bazel"} {
+		if _, err := os.Stat(filepath.Join(c.workspace, dir, build)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold c.mu
+func (c *QueryCache) clear() {
+	for _, entry := range c.entries() {
+		os.Remove(entry)
+	}
+}
+
+// dropPackage drops the results of the queries referring to the workspace
+// relative package directory.
+//
+// must hold c.mu
+func (c *QueryCache) dropPackage(dir string) {
+	for _, file := range c.entries() {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		entry := queryCacheEntry{}
+		if json.Unmarshal(b, &entry) != nil || queryRefersTo(entry.Expr, dir) {
+			os.Remove(file)
+		}
+	}
+}
+
+func (c *QueryCache) entries() []string {
+	files, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	entries := files[:0]
+	for _, f := range files {
+		if filepath.Base(f) != queryCacheIndex {
+			entries = append(entries, f)
+		}
+	}
+	return entries
+}
+
+// queryRefersTo reports whether the query expression refers to the
+// workspace relative package directory, with a label or target pattern of
+// the package or of a parent directory with "/...".
+func queryRefersTo(expr, dir string) bool {
+	dir = filepath.ToSlash(dir)
+	for _, m := range queryPackageRe.FindAllStringSubmatch(expr, -1) {
+		pkg := m[2]
+		switch {
+		case pkg == "..." || pkg == dir:
+			return true
+		case strings.HasSuffix(pkg, "/..."):
+			pkg = strings.TrimSuffix(pkg, "/...")
+			if dir == pkg || strings.HasPrefix(dir, pkg+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeFileAtomic writes the file through a temporary file, so that other
+// processes never read a partial file.
+func writeFileAtomic(file string, b []byte) {
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// IsBuildFile reports whether the workspace relative path is a file which
+// can change the build graph.
+func IsBuildFile(path string) bool {
+	switch filepath.Base(path) {
+	case "BUILD", "BUILD.bazel", "WORKSPACE", "WORKSPACE.bazel", "WORKSPACE.bzlmod", "MODULE.bazel":
+		return true
+	}
+	return strings.HasSuffix(path, ".bzl")
+}
+
+// NewQueryCache returns a new QueryCache for the workspace, stored in the
+// given gobazel state directory.
+func NewQueryCache(workspace, stateDir string) *QueryCache {
+	dir := filepath.Join(stateDir, queryCacheDir)
+	os.MkdirAll(dir, 0755)
+	return &QueryCache{
+		dir:       dir,
+		workspace: workspace,
+	}
+}
@@ -0,0 +1,130 @@
+package exec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryRefersTo(t *testing.T) {
+	for _, tc := range []struct {
+		expr, dir string
+		want      bool
+	}{
+		{"//a/b:all", "a/b", true},
+		{"//a/b:all", "a/b/c", false},
+		{"//a/b", "a/b", true},
+		{"//a/...", "a/b/c", true},
+		{"//a/...", "ab", false},
+		{"//...", "a", true},
+		{"//:all", "", true},
+		{"//:all", "a", false},
+		{`kind("^(go_test) rule$", (//a/... - //a/vendor/...) + //b:all)`, "b", true},
+		{`kind("^(go_test) rule$", (//a/... - //a/vendor/...) + //b:all)`, "c", false},
+		{"rdeps(//..., set(//x:a.proto))", "y", true},
+		{"@repo//a/...", "a", false},
+	} {
+		if got := queryRefersTo(tc.expr, tc.dir); got != tc.want {
+			t.Errorf("queryRefersTo(%q, %q) = %v, want %v", tc.expr, tc.dir, got, tc.want)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	d, err := ioutil.TempDir("", "querycache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	ws, state := filepath.Join(d, "ws"), filepath.Join(d, "state")
+	writeFile(t, filepath.Join(ws, "a", "BUILD"), "a")
+	writeFile(t, filepath.Join(ws, "a", "a.go"), "a")
+	writeFile(t, filepath.Join(ws, "b", "BUILD"), "b")
+
+	put := func(c *QueryCache, expr string) {
+		_, key, _ := c.Get(expr)
+		c.Put(key, expr, []string{expr})
+	}
+	cached := func(c *QueryCache, expr string) bool {
+		_, _, ok := c.Get(expr)
+		return ok
+	}
+	// The files are also checked in the background.
+	indexed := func(c *QueryCache, rel string) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_, ok := c.index.Files[rel]
+		return ok
+	}
+
+	// The watching process tracks the files.
+	c := NewQueryCache(ws, state)
+	c.Track()
+	fingerprint := c.currentFingerprint()
+	put(c, "//a/...")
+	put(c, "//b:all")
+
+	// Other processes take its index as is.
+	writeFile(t, filepath.Join(ws, "b", "BUILD"), "b changed")
+	if other := NewQueryCache(ws, state); !cached(other, "//a/...") || !cached(other, "//b:all") {
+		t.Errorf("results of the tracked index aren't cached for other processes")
+	}
+
+	// Files created in a package drop the queries of the package.
+	writeFile(t, filepath.Join(ws, "a", "new.go"), "new")
+	c.Invalidate("create", filepath.Join("a", "new.go"))
+	if cached(c, "//a/...") || !cached(c, "//b:all") {
+		t.Errorf("after a file was created in a, //a/... cached %v, //b:all %v", cached(c, "//a/..."), cached(c, "//b:all"))
+	}
+
+	// Changed build files are rehashed.
+	c.Invalidate("write", filepath.Join("b", "BUILD"))
+	if c.currentFingerprint() == fingerprint {
+		t.Errorf("fingerprint didn't change with b/BUILD")
+	}
+	if cached(c, "//b:all") {
+		t.Errorf("//b:all is cached for the changed b/BUILD")
+	}
+	if other := NewQueryCache(ws, state); other.currentFingerprint() != c.currentFingerprint() {
+		t.Errorf("other processes don't see the changed fingerprint")
+	}
+
+	// So are the build files of moved directories.
+	if err := os.Rename(filepath.Join(ws, "a"), filepath.Join(ws, "c")); err != nil {
+		t.Fatal(err)
+	}
+	c.Invalidate("rename", "a")
+	c.Invalidate("rename", "c")
+	if indexed(c, filepath.Join("a", "BUILD")) {
+		t.Errorf("a/BUILD is still indexed after a moved")
+	}
+	if !indexed(c, filepath.Join("c", "BUILD")) {
+		t.Errorf("c/BUILD isn't indexed after a moved to c")
+	}
+
+	// Without a tracking process, other processes check the files.
+	c.mu.Lock()
+	c.index.Pid = 0
+	c.writeIndex()
+	tracked := c.index.Fingerprint
+	c.mu.Unlock()
+	writeFile(t, filepath.Join(ws, "b", "BUILD"), "b changed again")
+	if other := NewQueryCache(ws, state); other.currentFingerprint() == tracked {
+		t.Errorf("fingerprint didn't change with b/BUILD without a tracking process")
+	}
+
+	if tmps, _ := filepath.Glob(filepath.Join(state, queryCacheDir, "*.tmp")); len(tmps) > 0 {
+		t.Errorf("temporary files are left: %v", tmps)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/exec"
+	"github.com/linuxerwang/gobazel/gopathfs"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+func newRewriter(cfg *conf.GobazelConf) *pathmap.Rewriter {
+	sdkDir, _ := gopathfs.FindGoSDKDir(dirs.Workspace)
+	return pathmap.NewRewriter(pathmap.New(cfg, dirs.Workspace, dirs.SrcDir), sdkDir)
+}
+
+// filter copies stdin to stdout, rewriting bazel paths to virtual GOPATH
+// paths.
+func filter(cfg *conf.GobazelConf) {
+	w := newRewriter(cfg).Writer(os.Stdout)
+	if _, err := io.Copy(w, os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to filter,", err)
+	}
+	w.Close()
+}
+
+// bazelWrapper runs bazel with the given arguments and streams its output
+// through the path rewriter. It exits with bazel's exit code.
+func bazelWrapper(cfg *conf.GobazelConf, args []string) {
+	exitWith(runBazelFiltered(cfg, args, os.Stdout, os.Stderr))
+}
+
+func runBazelFiltered(cfg *conf.GobazelConf, args []string, stdout, stderr io.Writer) error {
+	rw := newRewriter(cfg)
+	out := rw.Writer(stdout)
+	errOut := rw.Writer(stderr)
+
+	err := exec.RunBazelPiped(dirs.Workspace, args, out, errOut)
+	out.Close()
+	errOut.Close()
+	return err
+}
+
+func exitWith(err error) {
+	if err == nil {
+		return
+	}
+	if ee, ok := err.(*osexec.ExitError); ok {
+		if code := ee.ExitCode(); code > 0 {
+			os.Exit(code)
+		}
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/exec"
+	"github.com/linuxerwang/gobazel/pathmap"
+	"github.com/linuxerwang/gobazel/testjson"
+)
+
+// The rule kinds each Go style command works on.
+var goCmdKinds = map[string]string{
+	"test":  "go_test",
+	"build": "go_library|go_binary",
+	"run":   "go_binary",
+}
+
+// goCommand translates Go package patterns into bazel targets and runs the
+// bazel command of the same name on them.
+func goCommand(cfg *conf.GobazelConf, command string, args []string) {
+	bzlFlags, patterns, cmdArgs, err := splitGoCmdArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// "gobazel test -json" prints the results as "go test -json" does, bazel's
+	// own output goes to stderr.
+	jsonOut := false
+	if command == "test" {
+		for i, f := range bzlFlags {
+			if f == "-json" || f == "--json" {
+				jsonOut = true
+				bzlFlags = append(bzlFlags[:i:i], bzlFlags[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+
+	targets, err := goPatternTargets(cfg, command, patterns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(targets) == 0 {
+		fmt.Fprintf(os.Stderr, "No %s targets matched %s.\n", goCmdKinds[command], strings.Join(patterns, " "))
+		os.Exit(1)
+	}
+	if command == "run" && len(targets) > 1 {
+		fmt.Fprintf(os.Stderr, "%s matched more than one binary: %s.\n", strings.Join(patterns, " "), strings.Join(targets, " "))
+		os.Exit(2)
+	}
+
+	bzlArgs := append([]string{command}, bzlFlags...)
+	bzlArgs = append(bzlArgs, targets...)
+	if len(cmdArgs) > 0 {
+		switch command {
+		case "test":
+			for _, arg := range cmdArgs {
+				bzlArgs = append(bzlArgs, "--test_arg="+arg)
+			}
+		case "run":
+			bzlArgs = append(append(bzlArgs, "--"), cmdArgs...)
+		}
+	}
+
+	if !jsonOut {
+		bazelWrapper(cfg, bzlArgs)
+		return
+	}
+
+	err = runBazelFiltered(cfg, bzlArgs, os.Stderr, os.Stderr)
+	if testsRan(err) {
+		writeTestJSON(cfg, targets)
+	}
+	exitWith(err)
+}
+
+// testsRan reports whether bazel ran the tests, i.e., it succeeded or only
+// tests failed (exit code 3). Otherwise bazel-testlogs holds the results of
+// an earlier run.
+func testsRan(err error) bool {
+	if err == nil {
+		return true
+	}
+	ee, ok := err.(*osexec.ExitError)
+	return ok && ee.ExitCode() == 3
+}
+
+// testJSON prints the results of already run tests as "go test -json" does.
+func testJSON(cfg *conf.GobazelConf, args []string) {
+	_, patterns, _, err := splitGoCmdArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+
+	targets, err := goPatternTargets(cfg, "test", patterns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if !writeTestJSON(cfg, targets) {
+		os.Exit(1)
+	}
+}
+
+// writeTestJSON converts the bazel-testlogs of the given test targets into
+// test2json events on stdout. It reports whether all results were found.
+func writeTestJSON(cfg *conf.GobazelConf, targets []string) bool {
+	mapper := pathmap.New(cfg, dirs.Workspace, dirs.SrcDir)
+	conv := testjson.NewConverter(os.Stdout, newRewriter(cfg))
+
+	ok := true
+	for _, target := range targets {
+		pkg, name := exec.SplitLabel(target)
+		testDir := filepath.Join(dirs.Workspace, "bazel-testlogs", pkg, name)
+		if err := conv.Convert(testDir, mapper.ImportPath(pkg)); err != nil {
+			fmt.Fprintf(os.Stderr, "No test results for %s, %v.\n", target, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Bazel flags which take their value from the next argument, e.g.,
+// "-c dbg". Other flags need "--flag=value", see splitGoCmdArgs.
+var bazelValueFlags = map[string]struct{}{
+	"-c":                    {},
+	"--compilation_mode":    {},
+	"--config":              {},
+	"--define":              {},
+	"--copt":                {},
+	"--linkopt":             {},
+	"--platforms":           {},
+	"--action_env":          {},
+	"--repo_env":            {},
+	"-j":                    {},
+	"--jobs":                {},
+	"--run_under":           {},
+	"--test_arg":            {},
+	"--test_env":            {},
+	"--test_filter":         {},
+	"--test_output":         {},
+	"--test_timeout":        {},
+	"--test_tag_filters":    {},
+	"--runs_per_test":       {},
+	"--flaky_test_attempts": {},
+	"--build_tag_filters":   {},
+	"--strategy":            {},
+	"--disk_cache":          {},
+	"--remote_cache":        {},
+}
+
+// splitGoCmdArgs splits the arguments into bazel flags, package patterns
+// and the arguments after "--". Flags not in bazelValueFlags are taken as
+// boolean flags unless written as "--flag=value"; an unknown flag followed
+// by an argument which isn't a package pattern is an error rather than
+// silently querying the flag's value as a pattern.
+func splitGoCmdArgs(args []string) (flags, patterns, cmdArgs []string, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return flags, patterns, args[i+1:], nil
+		case strings.HasPrefix(arg, "-"):
+			flags = append(flags, arg)
+			if i+1 == len(args) || strings.HasPrefix(args[i+1], "-") || strings.Contains(arg, "=") {
+				break
+			}
+			if _, ok := bazelValueFlags[arg]; ok {
+				i++
+				flags = append(flags, args[i])
+			} else if !isGoPattern(args[i+1]) {
+				return nil, nil, nil, fmt.Errorf("%s is no Go package pattern, write flag %s with its value as %s=%s", args[i+1], arg, arg, args[i+1])
+			}
+		default:
+			patterns = append(patterns, arg)
+		}
+	}
+	return flags, patterns, nil, nil
+}
+
+// isGoPattern reports whether the argument looks like a Go package pattern
+// or bazel label: relative, absolute or with a slash, as all import paths
+// below the Go package prefix and of vendored packages have.
+func isGoPattern(arg string) bool {
+	for _, prefix := range []string{".", "/", "@", ":"} {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return strings.Contains(arg, "/")
+}
+
+// goPatternTargets queries the bazel targets of the command's rule kinds
+// matching the given Go package patterns.
+func goPatternTargets(cfg *conf.GobazelConf, command string, patterns []string) ([]string, error) {
+	mapper := pathmap.New(cfg, dirs.Workspace, dirs.SrcDir)
+
+	exprs := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr, err := goPatternToBazel(cfg, mapper, pattern)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+
+	query := fmt.Sprintf("kind(\"^(%s) rule$\", %s)", goCmdKinds[command], strings.Join(exprs, " + "))
+	return exec.RunBazelQueryTargets(dirs.Workspace, query, exec.NewQueryCache(dirs.Workspace, dirs.StateDir))
+}
+
+// goPatternToBazel translates a Go package pattern into a bazel target
+// pattern (or query expression).
+func goPatternToBazel(cfg *conf.GobazelConf, mapper *pathmap.Mapper, pattern string) (string, error) {
+	// Bazel labels are taken as is.
+	if strings.HasPrefix(pattern, "//") || strings.HasPrefix(pattern, "@") || strings.HasPrefix(pattern, ":") {
+		return pattern, nil
+	}
+
+	recursive := false
+	if pattern == "..." {
+		pattern, recursive = ".", true
+	} else if strings.HasSuffix(pattern, "/...") {
+		pattern, recursive = strings.TrimSuffix(pattern, "/..."), true
+	}
+
+	var dir string
+	var ok bool
+	if pattern == "." || pattern == ".." || strings.HasPrefix(pattern, "./") || strings.HasPrefix(pattern, "../") {
+		dir, ok = relativeGoPatternDir(mapper, pattern)
+	} else {
+		dir, ok = mapper.ImportPathDir(pattern)
+	}
+	if !ok {
+		return "", fmt.Errorf("can not map Go package pattern %s to a bazel package", pattern)
+	}
+	dir = filepath.ToSlash(dir)
+
+	if !recursive {
+		return "//" + dir + ":all", nil
+	}
+
+	expr := "//" + strings.TrimPrefix(dir+"/...", "/")
+	// Like the go command, "..." doesn't match vendored packages unless
+	// the pattern is inside the vendor directory.
+	for _, vendor := range cfg.Vendors {
+		if dir == "" || strings.HasPrefix(vendor, dir+"/") {
+			expr = fmt.Sprintf("(%s - //%s/...)", expr, vendor)
+		}
+	}
+	return expr, nil
+}
+
+// relativeGoPatternDir resolves a relative pattern against the current
+// directory, which is either in the workspace or in the virtual GOPATH.
+func relativeGoPatternDir(mapper *pathmap.Mapper, pattern string) (string, bool) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", false
+	}
+	abs := filepath.Join(wd, pattern)
+
+	if rel, err := filepath.Rel(dirs.Workspace, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		if rel == "." {
+			rel = ""
+		}
+		return rel, true
+	}
+	return mapper.VirtualDir(abs)
+}
@@ -1,87 +1,123 @@
 package gopathfs
 
 import (
-	"path/filepath"
-	"strings"
+	"context"
+	"os"
+	"syscall"
+	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
 )
 
-// GetAttr overwrites the parent's GetAttr method.
-func (gpf *GoPathFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	if name == "" {
-		return gpf.getTopDirAttr()
+// Getattr returns the attributes of the node.
+func (n *node) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	attr, status := n.self.attr()
+	if status != fuse.OK {
+		return syscall.Errno(status)
 	}
+	out.Attr = *attr
+	out.Ino = n.StableAttr().Ino
+	return 0
+}
 
-	// Handle the virtual Golang prefix package.
-	if name == gpf.cfg.GoPkgPrefix {
-		return gpf.getFirstPartyDirAttr()
+// Setattr changes the attributes of the real file, through the opened file
+// if any.
+func (n *node) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if f, ok := fh.(fs.FileSetattrer); ok {
+		return f.Setattr(ctx, in, out)
 	}
 
-	// Handle the children of the virtual Golang prefix package.
-	prefix := gpf.cfg.GoPkgPrefix + pathSeparator
-	if strings.HasPrefix(name, prefix) {
-		name = name[len(prefix):]
-		attr, status := gpf.getFirstPartyChildDirAttr(name)
-		if status == fuse.OK {
-			return attr, fuse.OK
+	real, status := n.realPath()
+	if status != fuse.OK {
+		return syscall.Errno(status)
+	}
+	if mode, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(real, mode); err != nil {
+			return fs.ToErrno(err)
 		}
 	}
-
-	// Search in fall-through directories.
-	for _, v := range gpf.cfg.FallThrough {
-		if name == v || strings.HasPrefix(name, v) {
-			return gpf.getRealDirAttr(filepath.Join(gpf.dirs.Workspace, name))
+	if size, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(real, int64(size)); err != nil {
+			return fs.ToErrno(err)
 		}
 	}
-
-	// Search in vendor directories.
-	for _, v := range gpf.cfg.Vendors {
-		fname := filepath.Join(gpf.dirs.Workspace, v, name)
-		attr, status := gpf.getRealDirAttr(fname)
-		if status == fuse.OK {
-			return attr, fuse.OK
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		// The time which isn't set is kept.
+		attr, status := n.gpf.getRealDirAttr(real)
+		if status != fuse.OK {
+			return syscall.Errno(status)
 		}
-
-		// Also search in bezel-genfiles.
-		fname = filepath.Join(gpf.dirs.Workspace, "bazel-genfiles", v, name)
-		attr, status = gpf.getRealDirAttr(fname)
-		if status == fuse.OK {
-			return attr, fuse.OK
+		if !aok {
+			atime = time.Unix(int64(attr.Atime), int64(attr.Atimensec))
+		}
+		if !mok {
+			mtime = time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+		}
+		if err := os.Chtimes(real, atime, mtime); err != nil {
+			return fs.ToErrno(err)
 		}
 	}
-
-	return nil, fuse.ENOENT
+	return n.Getattr(ctx, fh, out)
 }
 
-func (gpf *GoPathFs) getTopDirAttr() (*fuse.Attr, fuse.Status) {
-	return &fuse.Attr{
-		Mode: fuse.S_IFDIR | 0755,
-	}, fuse.OK
-}
+// attr stats the real path of the node. If the cached real path is gone,
+// another real tree may provide the node now.
+func (n *node) attr() (*fuse.Attr, fuse.Status) {
+	real, status := n.realPath()
+	if status != fuse.OK {
+		return nil, status
+	}
+	attr, status := n.gpf.getRealDirAttr(real)
+	if status != fuse.OK {
+		n.forget()
+		if real, status = n.realPath(); status != fuse.OK {
+			return nil, status
+		}
+		if attr, status = n.gpf.getRealDirAttr(real); status != fuse.OK {
+			return nil, status
+		}
+	}
 
-func (gpf *GoPathFs) getFirstPartyDirAttr() (*fuse.Attr, fuse.Status) {
-	return &fuse.Attr{
-		Mode: fuse.S_IFDIR | 0755,
-	}, fuse.OK
+	// The real directory doesn't know the subdirectories of the others.
+	if attr.Mode&syscall.S_IFMT == syscall.S_IFDIR && len(n.self.realDirs()) > 1 {
+		attr.Nlink = n.dirLinks()
+	}
+	return attr, fuse.OK
 }
 
-func (gpf *GoPathFs) getFirstPartyChildDirAttr(name string) (*fuse.Attr, fuse.Status) {
-	// Search in GOROOT (for debugger).
-	if name == "GOROOT" || strings.HasPrefix(name, "GOROOT"+pathSeparator) {
-		return gpf.getRealDirAttr(filepath.Join(gpf.dirs.GoSDKDir, name[len("GOROOT"):]))
+// syntheticDirAttr returns the attributes of a directory which only exists
+// in the virtual tree. It has the times and owner of the workspace.
+func (n *node) syntheticDirAttr() (*fuse.Attr, fuse.Status) {
+	attr, status := n.gpf.getRealDirAttr(n.gpf.dirs.Workspace)
+	if status != fuse.OK {
+		attr = &fuse.Attr{}
 	}
+	attr.Ino = 0
+	attr.Mode = fuse.S_IFDIR | 0755
+	attr.Nlink = n.dirLinks()
+	return attr, fuse.OK
+}
 
-	nm := filepath.Join(gpf.dirs.Workspace, name)
-	attr, status := gpf.getRealDirAttr(name)
-	if status == fuse.OK {
-		return attr, fuse.OK
+// dirLinks returns the link count of the virtual directory, i.e., 2 plus
+// the number of subdirectories. If the directory isn't indexed it's 1, which
+// tools like find take as unknown.
+func (n *node) dirLinks() uint32 {
+	path, _ := n.paths()
+	entries, _, ok := n.gpf.index.listing(path)
+	if !ok {
+		return 1
 	}
-
-	// Search in bazel-genfiles directories.
-	nm = filepath.Join(gpf.dirs.Workspace, "bazel-genfiles", name)
-	return gpf.getRealDirAttr(nm)
+	links := uint32(2)
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			links++
+		}
+	}
+	return links
 }
 
 func (gpf *GoPathFs) getRealDirAttr(name string) (*fuse.Attr, fuse.Status) {
@@ -1,73 +1,106 @@
 package gopathfs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"syscall"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-// OpenDir overwrites the parent's OpenDir method.
-func (gpf *GoPathFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
-	if name == "" {
-		return gpf.openTopDir()
+// Readdir lists the virtual directory.
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	path, _ := n.paths()
+	entries, status, ok := n.gpf.index.listing(path)
+	if !ok {
+		entries, status = n.self.list()
 	}
-
-	if name == gpf.cfg.GoPkgPrefix {
-		return gpf.openFirstPartyDir()
+	if status != fuse.OK {
+		return nil, syscall.Errno(status)
 	}
 
-	if strings.HasPrefix(name, gpf.cfg.GoPkgPrefix+pathSeparator) {
-		return gpf.openFirstPartyChildDir(name)
+	// The listings are shared with the index.
+	list := make([]fuse.DirEntry, len(entries))
+	for i, e := range entries {
+		e.Ino = n.gpf.inodes.peek(inodeKey{
+			path: filepath.Join(path, e.Name),
+			dir:  e.Mode&syscall.S_IFMT == syscall.S_IFDIR,
+		})
+		list[i] = e
 	}
+	return fs.NewListDirStream(list), 0
+}
 
-	entries := []fuse.DirEntry{}
-	var status fuse.Status
+// list merges the listings of the real directories.
+func (n *node) list() ([]fuse.DirEntry, fuse.Status) {
+	return n.listDirs(n.gpf.cfg.FallThroughSet)
+}
 
-	// Search in fall-through directories.
-	for _, dir := range gpf.cfg.FallThrough {
-		if dir == name || strings.HasPrefix(name, dir) {
-			fname := filepath.Join(gpf.dirs.Workspace, name)
-			entries, status = gpf.openUnderlyingDir(fname, nil /* excludes */, entries)
-			if status == fuse.OK {
-				return entries, fuse.OK
+func (n *node) listDirs(excludes map[string]struct{}) ([]fuse.DirEntry, fuse.Status) {
+	entries := []fuse.DirEntry{}
+	found := false
+	for _, rd := range n.self.realDirs() {
+		var status fuse.Status
+		start := len(entries)
+		entries, status = n.gpf.openUnderlyingDir(rd.path, excludes, entries)
+		found = found || status == fuse.OK
+
+		served := entries[:start]
+		for _, e := range entries[start:] {
+			if rd.serves(e.Name, e.Mode&syscall.S_IFMT == syscall.S_IFDIR) {
+				served = append(served, e)
 			}
-			fmt.Printf("failed to open entry %s\n", fname)
-			return nil, fuse.ENOENT
 		}
+		entries = served
 	}
-
-	// Search in vendor directories.
-	for _, vendor := range gpf.cfg.Vendors {
-		entries, status = gpf.openVendorChildDir(vendor, name, entries)
-		if status == fuse.OK {
-			return entries, fuse.OK
-		}
+	if !found {
+		path, _ := n.paths()
+		fmt.Printf("failed to open entry %s\n", path)
+		return nil, fuse.ENOENT
 	}
-
-	return nil, fuse.ENOENT
+	return entries, fuse.OK
 }
 
-// Mkdir overwrites the parent's Mkdir method.
-func (gpf *GoPathFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	prefix := gpf.cfg.GoPkgPrefix + pathSeparator
-	if strings.HasPrefix(name, prefix) {
-		return gpf.mkFirstPartyChildDir(name[len(prefix):], mode, context)
+// Mkdir creates the directory in the real directory of the node.
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	dir, status := n.targetDir()
+	if status != fuse.OK {
+		return nil, syscall.Errno(status)
 	}
+	c := n.self.child(name)
+	path, _ := c.base().paths()
+	defer n.gpf.index.changed(path)
 
-	return gpf.mkThirdPartyChildDir(name, mode, context)
+	if err := os.MkdirAll(filepath.Join(dir, name), os.FileMode(mode)); err != nil {
+		return nil, syscall.ENOENT
+	}
+	c.base().setReal(filepath.Join(dir, name))
+	attr, status := c.attr()
+	if status != fuse.OK {
+		return nil, syscall.Errno(status)
+	}
+	out.Attr = *attr
+	return n.childInode(ctx, name, c, attr), 0
 }
 
-// Rmdir overwrites the parent's Rmdir method.
-func (gpf *GoPathFs) Rmdir(name string, context *fuse.Context) fuse.Status {
-	prefix := gpf.cfg.GoPkgPrefix + pathSeparator
-	if strings.HasPrefix(name, prefix) {
-		return gpf.rmFirstPartyChildDir(name[len(prefix):], context)
-	}
+// Rmdir removes the directory from the real directory providing it.
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	c := n.self.child(name)
+	path, _ := c.base().paths()
+	defer n.gpf.index.changed(path)
 
-	return gpf.rmThirdPartyChildDir(name, context)
+	real, status := c.base().sourcePath()
+	if status != fuse.OK {
+		return syscall.Errno(status)
+	}
+	if err := os.RemoveAll(real); err != nil {
+		return syscall.ENOENT
+	}
+	n.gpf.inodes.remove(path)
+	return 0
 }
 
 func (gpf *GoPathFs) openTopDir() ([]fuse.DirEntry, fuse.Status) {
@@ -140,36 +173,6 @@ func (gpf *GoPathFs) openFirstPartyDir() ([]fuse.DirEntry, fuse.Status) {
 	return entries, fuse.OK
 }
 
-func (gpf *GoPathFs) openFirstPartyChildDir(name string) ([]fuse.DirEntry, fuse.Status) {
-	name = name[len(gpf.cfg.GoPkgPrefix+pathSeparator):]
-	entries := []fuse.DirEntry{}
-
-	// Search in GOROOT (for debugger).
-	if name == "GOROOT" || strings.HasPrefix(name, "GOROOT"+pathSeparator) {
-		fname := filepath.Join(gpf.dirs.GoSDKDir, name[len("GOROOT"):])
-		entries, status := gpf.openUnderlyingDir(fname, nil /* excludes */, entries)
-		if status == fuse.OK {
-			return entries, fuse.OK
-		}
-		fmt.Printf("failed to open entry %s\n", fname)
-		return nil, fuse.ENOENT
-	}
-
-	entries, _ = gpf.openUnderlyingDir(filepath.Join(gpf.dirs.Workspace, name), gpf.cfg.FallThroughSet /* excludes */, entries)
-	// Also search in bazel-genfiles.
-	entries, _ = gpf.openUnderlyingDir(filepath.Join(gpf.dirs.Workspace, "bazel-genfiles", name), gpf.cfg.FallThroughSet /* excludes */, entries)
-
-	return entries, fuse.OK
-}
-
-func (gpf *GoPathFs) openVendorChildDir(vendor, name string, entries []fuse.DirEntry) ([]fuse.DirEntry, fuse.Status) {
-	entries, _ = gpf.openUnderlyingDir(filepath.Join(gpf.dirs.Workspace, vendor, name), gpf.cfg.FallThroughSet /* excludes */, entries)
-	// Also search in bazel-genfiles.
-	entries, _ = gpf.openUnderlyingDir(filepath.Join(gpf.dirs.Workspace, "bazel-genfiles", vendor, name), gpf.cfg.FallThroughSet /* excludes */, entries)
-
-	return entries, fuse.OK
-}
-
 func (gpf *GoPathFs) openUnderlyingDir(dir string, excludes map[string]struct{}, entries []fuse.DirEntry) ([]fuse.DirEntry, fuse.Status) {
 	h, err := os.Open(dir)
 	if err != nil {
@@ -211,43 +214,3 @@ outterLoop:
 
 	return entries, fuse.OK
 }
-
-func (gpf *GoPathFs) mkFirstPartyChildDir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	name = filepath.Join(gpf.dirs.Workspace, name)
-	if err := os.MkdirAll(name, os.FileMode(mode)); err != nil {
-		return fuse.ENOENT
-	}
-	return fuse.OK
-}
-
-func (gpf *GoPathFs) mkThirdPartyChildDir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	if len(gpf.cfg.Vendors) == 0 {
-		return fuse.ENOENT
-	}
-
-	name = filepath.Join(gpf.dirs.Workspace, gpf.cfg.Vendors[0], name)
-	if err := os.MkdirAll(name, os.FileMode(mode)); err != nil {
-		return fuse.ENOENT
-	}
-	return fuse.OK
-}
-
-func (gpf *GoPathFs) rmFirstPartyChildDir(name string, context *fuse.Context) fuse.Status {
-	name = filepath.Join(gpf.dirs.Workspace, name)
-	if err := os.RemoveAll(name); err != nil {
-		return fuse.ENOENT
-	}
-	return fuse.OK
-}
-
-func (gpf *GoPathFs) rmThirdPartyChildDir(name string, context *fuse.Context) fuse.Status {
-	if len(gpf.cfg.Vendors) == 0 {
-		return fuse.ENOENT
-	}
-
-	name = filepath.Join(gpf.dirs.Workspace, gpf.cfg.Vendors[0], name)
-	if err := os.RemoveAll(name); err != nil {
-		return fuse.ENOENT
-	}
-	return fuse.OK
-}
@@ -0,0 +1,58 @@
+package gopathfs
+
+import (
+	"sync"
+
+	"github.com/rjeczalik/notify"
+)
+
+// eventQueue takes the events of a notify channel as fast as they come.
+// notify drops events when the channel is full, without telling (nor does
+// it pass on the kernel's queue overflows), so the channel is drained into
+// an unbounded queue and a full channel is the signal that events were lost.
+type eventQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	events   []notify.EventInfo
+	overflow bool
+}
+
+// fill moves the events of ch into the queue.
+func (q *eventQueue) fill(ch <-chan notify.EventInfo) {
+	for {
+		// Sends to a full channel are dropped.
+		full := len(ch) == cap(ch)
+		ei, ok := <-ch
+		if !ok {
+			return
+		}
+
+		q.mu.Lock()
+		q.events = append(q.events, ei)
+		if full {
+			q.overflow = true
+		}
+		q.mu.Unlock()
+		q.cond.Signal()
+	}
+}
+
+// take waits for events, and returns all queued ones and whether events
+// were lost before them.
+func (q *eventQueue) take() ([]notify.EventInfo, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.events) == 0 {
+		q.cond.Wait()
+	}
+	events, overflow := q.events, q.overflow
+	q.events, q.overflow = nil, false
+	return events, overflow
+}
+
+func newEventQueue() *eventQueue {
+	q := eventQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return &q
+}
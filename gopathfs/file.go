@@ -1,162 +1,197 @@
 package gopathfs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"syscall"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
 )
 
-// Open overwrites the parent's Open method.
-func (gpf *GoPathFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	if gpf.debug {
-		fmt.Printf("\nReqeusted to open file %s.\n", name)
+// Open opens the real file of the node.
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if n.gpf.debug {
+		path, _ := n.paths()
+		fmt.Printf("\nReqeusted to open file %s.\n", path)
 	}
 
-	if strings.HasPrefix(name, gpf.cfg.GoPkgPrefix+pathSeparator) {
-		return gpf.openFirstPartyChildFile(name, flags, context)
+	real, status := n.realPath()
+	if status != fuse.OK {
+		return nil, 0, syscall.Errno(status)
 	}
-
-	// Search in fall-through directories.
-	for _, path := range gpf.cfg.FallThrough {
-		if path == name || strings.HasPrefix(name, path) {
-			f, status := gpf.openUnderlyingFile(filepath.Join(gpf.dirs.Workspace, name), flags, context)
-			if status == fuse.OK {
-				return f, status
-			}
-			return nil, fuse.ENOENT
+	f, status := n.gpf.openUnderlyingFile(real, flags)
+	if status == fuse.ENOENT {
+		// Another real tree may provide the file now.
+		n.forget()
+		if real, status = n.realPath(); status == fuse.OK {
+			f, status = n.gpf.openUnderlyingFile(real, flags)
 		}
 	}
-
-	// Search in vendor directories.
-	for _, vendor := range gpf.cfg.Vendors {
-		f, status := gpf.openVendorChildFile(vendor, name, flags, context)
-		if status == fuse.OK {
-			return f, status
-		}
+	if status != fuse.OK {
+		return nil, 0, syscall.Errno(status)
 	}
-
-	return nil, fuse.ENOENT
+	fh, errno := n.gpf.loopbackFile(f)
+	return fh, 0, errno
 }
 
-// Create overwrites the parent's Create method.
-func (gpf *GoPathFs) Create(name string, flags uint32, mode uint32,
-	context *fuse.Context) (file nodefs.File, code fuse.Status) {
-
-	if gpf.debug {
-		fmt.Printf("\nReqeusted to create file %s.\n", name)
+// Create creates the file in the real directory of the node.
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	c := n.self.child(name)
+	path, _ := c.base().paths()
+	if n.gpf.debug {
+		fmt.Printf("\nReqeusted to create file %s.\n", path)
 	}
+	defer n.gpf.index.changed(path)
 
-	prefix := gpf.cfg.GoPkgPrefix + pathSeparator
-	if strings.HasPrefix(name, prefix) {
-		return gpf.createFirstPartyChildFile(name[len(prefix):], flags, mode, context)
+	dir, status := n.targetDir()
+	if status != fuse.OK {
+		return nil, nil, 0, syscall.EIO
+	}
+	real := filepath.Join(dir, name)
+	f, status := n.gpf.createUnderlyingFile(real, mode)
+	if status != fuse.OK {
+		return nil, nil, 0, syscall.Errno(status)
+	}
+	fh, errno := n.gpf.loopbackFile(f)
+	if errno != 0 {
+		return nil, nil, 0, errno
 	}
 
-	return gpf.createThirdPartyChildFile(name, flags, mode, context)
+	c.base().setReal(real)
+	attr, status := c.attr()
+	if status != fuse.OK {
+		fh.(fs.FileReleaser).Release(ctx)
+		return nil, nil, 0, syscall.Errno(status)
+	}
+	out.Attr = *attr
+	return n.childInode(ctx, name, c, attr), fh, 0, 0
 }
 
-// Unlink overwrites the parent's Unlink method.
-func (gpf *GoPathFs) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	if gpf.debug {
-		fmt.Printf("\nReqeusted to unlink file %s.\n", name)
+// Unlink removes the file from the real directory providing it.
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	c := n.self.child(name)
+	path, _ := c.base().paths()
+	if n.gpf.debug {
+		fmt.Printf("\nReqeusted to unlink file %s.\n", path)
 	}
+	defer n.gpf.index.changed(path)
 
-	prefix := gpf.cfg.GoPkgPrefix + pathSeparator
-	if strings.HasPrefix(name, prefix) {
-		name = filepath.Join(gpf.dirs.Workspace, name[len(prefix):])
-		return gpf.unlinkUnderlyingFile(name, context)
+	real, status := c.base().sourcePath()
+	if status != fuse.OK {
+		return syscall.ENOSYS
 	}
-
-	// Vendor directories.
-	for _, vendor := range gpf.cfg.Vendors {
-		name = filepath.Join(gpf.dirs.Workspace, vendor, name)
-		if status := gpf.unlinkUnderlyingFile(name, context); status == fuse.OK {
-			return status
-		}
+	if status := n.gpf.unlinkUnderlyingFile(real); status != fuse.OK {
+		return syscall.Errno(status)
 	}
-
-	return fuse.ENOSYS
+	n.gpf.inodes.remove(path)
+	return 0
 }
 
-// Rename overwrites the parent's Rename method.
-func (gpf *GoPathFs) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
-	if gpf.debug {
-		fmt.Printf("\nReqeusted to rename from %s to %s.\n", oldName, newName)
+// Rename renames the file in the real directories. Files only move to
+// another type of directory (e.g., from a vendor directory to the
+// workspace) on the same device, otherwise the caller has to copy them.
+func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	p, ok := newParent.(virtualNode)
+	if !ok {
+		return syscall.EXDEV
 	}
+	oc, nc := n.self.child(name), p.child(newName)
+	oldPath, _ := oc.base().paths()
+	newPath, newRel := nc.base().paths()
+	if n.gpf.debug {
+		fmt.Printf("\nReqeusted to rename from %s to %s.\n", oldPath, newPath)
+	}
+	defer n.gpf.index.changed(newPath)
+	defer n.gpf.index.changed(oldPath)
 
-	if strings.HasPrefix(oldName, gpf.cfg.GoPkgPrefix+pathSeparator) {
-		oldName = filepath.Join(gpf.dirs.Workspace, oldName[len(gpf.cfg.GoPkgPrefix):])
-		newName = filepath.Join(gpf.dirs.Workspace, newName[len(gpf.cfg.GoPkgPrefix):])
-	} else {
-		// Vendor directories.
-		for _, vendor := range gpf.cfg.Vendors {
-			oldName = filepath.Join(vendor, oldName)
-			if _, err := os.Stat(oldName); err == nil {
-				newName = filepath.Join(vendor, newName)
-				break
-			}
-		}
-		if newName == "" || oldName == "" {
-			return fuse.ENOSYS
-		}
+	oldName, status := oc.base().sourcePath()
+	if status != fuse.OK {
+		return syscall.ENOSYS
+	}
+	dir, status := p.base().targetDir()
+	if status != fuse.OK {
+		return syscall.ENOSYS
 	}
+	if !sameType(oc, nc) && !sameDevice(oldName, dir) {
+		return syscall.EXDEV
+	}
+	newName = filepath.Join(dir, newName)
 
-	if gpf.debug {
+	if n.gpf.debug {
 		fmt.Printf("Actual rename from %s to %s ... ", oldName, newName)
 	}
 	if err := os.Rename(oldName, newName); err != nil {
-		if gpf.debug {
-			fmt.Println("failed to rename file %s,", oldName, err)
+		if n.gpf.debug {
+			fmt.Printf("failed to rename file %s, %v.\n", oldName, err)
 		}
-		return fuse.ENOSYS
+		return syscall.ENOSYS
 	}
-	if gpf.debug {
-		fmt.Println("Succeeded to rename file %s.\n", oldName)
+	if n.gpf.debug {
+		fmt.Printf("Succeeded to rename file %s.\n", oldName)
 	}
-	return fuse.OK
-}
-
-func (gpf *GoPathFs) openFirstPartyChildFile(name string, flags uint32,
-	context *fuse.Context) (file nodefs.File, code fuse.Status) {
-
-	name = name[len(gpf.cfg.GoPkgPrefix+pathSeparator):]
 
-	// Search in GOROOT (for debugger).
-	if name == "GOROOT" || strings.HasPrefix(name, "GOROOT"+pathSeparator) {
-		f, status := gpf.openUnderlyingFile(filepath.Join(gpf.dirs.GoSDKDir, name[len("GOROOT"):]), flags, context)
-		if status == fuse.OK {
-			return f, status
+	// The inode is moved to the new name once it returns.
+	if child := n.GetChild(name); child != nil {
+		if c, ok := child.Operations().(virtualNode); ok {
+			c.base().move(newPath, newRel)
 		}
-		return nil, fuse.ENOENT
 	}
+	return 0
+}
 
-	f, status := gpf.openUnderlyingFile(filepath.Join(gpf.dirs.Workspace, name), flags, context)
-	if status == fuse.OK {
-		return f, status
+// sameDevice reports whether the real paths are on the same device, so
+// they can be renamed into each other.
+func sameDevice(a, b string) bool {
+	ai, err := os.Lstat(a)
+	if err != nil {
+		return false
 	}
-
-	// Also search in bazel-genfiles.
-	return gpf.openUnderlyingFile(filepath.Join(gpf.dirs.Workspace, "bazel-genfiles", name), flags, context)
+	bi, err := os.Lstat(b)
+	if err != nil {
+		return false
+	}
+	as, aok := ai.Sys().(*syscall.Stat_t)
+	bs, bok := bi.Sys().(*syscall.Stat_t)
+	return aok && bok && as.Dev == bs.Dev
 }
 
-func (gpf *GoPathFs) openVendorChildFile(vendor, name string, flags uint32,
-	context *fuse.Context) (file nodefs.File, code fuse.Status) {
+// loopbackHandle is a loopback file without FUSE passthrough.
+type loopbackHandle interface {
+	fs.FileHandle
+	fs.FileReleaser
+	fs.FileGetattrer
+	fs.FileReader
+	fs.FileWriter
+	fs.FileGetlker
+	fs.FileSetlker
+	fs.FileSetlkwer
+	fs.FileLseeker
+	fs.FileFlusher
+	fs.FileFsyncer
+	fs.FileSetattrer
+	fs.FileAllocater
+}
 
-	f, status := gpf.openUnderlyingFile(filepath.Join(gpf.dirs.Workspace, vendor, name), flags, context)
-	if status == fuse.OK {
-		return f, status
+// loopbackFile returns the file handle of the opened file. If passthrough
+// is enabled, it passes its file descriptor to the kernel where possible.
+func (gpf *GoPathFs) loopbackFile(f *os.File) (fs.FileHandle, syscall.Errno) {
+	defer f.Close()
+	fd, err := unix.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, fs.ToErrno(err)
 	}
-
-	// Also search in bazel-genfiles.
-	return gpf.openUnderlyingFile(filepath.Join(gpf.dirs.Workspace, "bazel-genfiles", vendor, name), flags, context)
+	fh := fs.NewLoopbackFile(fd)
+	if !gpf.cfg.Passthrough {
+		return struct{ loopbackHandle }{fh.(loopbackHandle)}, 0
+	}
+	return fh, 0
 }
 
-func (gpf *GoPathFs) openUnderlyingFile(name string, flags uint32,
-	context *fuse.Context) (file nodefs.File, code fuse.Status) {
+func (gpf *GoPathFs) openUnderlyingFile(name string, flags uint32) (*os.File, fuse.Status) {
 
 	if gpf.debug {
 		fmt.Printf("Actually opening file %s.\n", name)
@@ -182,43 +217,10 @@ func (gpf *GoPathFs) openUnderlyingFile(name string, flags uint32,
 	if gpf.debug {
 		fmt.Printf("Succeeded to open file: %s.\n", name)
 	}
-	return nodefs.NewLoopbackFile(f), fuse.OK
-}
-
-func (gpf *GoPathFs) createFirstPartyChildFile(name string, flags uint32, mode uint32,
-	context *fuse.Context) (file nodefs.File, code fuse.Status) {
-
-	name = filepath.Join(gpf.dirs.Workspace, name)
-
-	if gpf.debug {
-		fmt.Printf("Actually creating file %s.\n", name)
-	}
-
-	f, err := os.Create(name)
-	if err != nil {
-		if gpf.debug {
-			fmt.Printf("Failed to create file %s.\n", name)
-		}
-		return nil, fuse.EIO
-	}
-
-	if err = os.Chmod(name, os.FileMode(mode)); err != nil {
-		fmt.Printf("Fail to chmod. file: %s, mode: %s, err: %#v.", name, os.FileMode(mode).String(), err)
-	}
-
-	if gpf.debug {
-		fmt.Printf("Succeeded to create file %s.\n", name)
-	}
-	return nodefs.NewLoopbackFile(f), fuse.OK
+	return f, fuse.OK
 }
 
-func (gpf *GoPathFs) createThirdPartyChildFile(name string, flags uint32, mode uint32,
-	context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	if len(gpf.cfg.Vendors) == 0 {
-		return nil, fuse.EIO
-	}
-
-	name = filepath.Join(gpf.dirs.Workspace, gpf.cfg.Vendors[0], name)
+func (gpf *GoPathFs) createUnderlyingFile(name string, mode uint32) (*os.File, fuse.Status) {
 	if gpf.debug {
 		fmt.Printf("Actually creating file %s.\n", name)
 	}
@@ -238,10 +240,10 @@ func (gpf *GoPathFs) createThirdPartyChildFile(name string, flags uint32, mode u
 	if gpf.debug {
 		fmt.Printf("Succeeded to create file %s.\n", name)
 	}
-	return nodefs.NewLoopbackFile(f), fuse.OK
+	return f, fuse.OK
 }
 
-func (gpf *GoPathFs) unlinkUnderlyingFile(name string, context *fuse.Context) (code fuse.Status) {
+func (gpf *GoPathFs) unlinkUnderlyingFile(name string) fuse.Status {
 	if gpf.debug {
 		fmt.Printf("Actually unlinking file %s.\n", name)
 	}
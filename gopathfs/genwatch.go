@@ -0,0 +1,199 @@
+package gopathfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rjeczalik/notify"
+)
+
+// genWatcher watches the bazel output tree of the generated files, which
+// lives outside the workspace, and invalidates the mapped virtual paths.
+// Only the directories of the packages served through the mount are
+// watched, the whole tree could exceed the inotify watch limit.
+type genWatcher struct {
+	gpf *GoPathFs
+	ch  chan notify.EventInfo
+
+	mu      sync.Mutex
+	root    string
+	updated bool
+	// served are the directories of the served packages, relative to the
+	// output tree. Missing ones are watched through their closest parent.
+	served  map[string]struct{}
+	watched map[string]struct{}
+}
+
+// update (re)starts watching the output tree if the generated files
+// directory resolves to another directory, e.g., after "bazel clean" or the
+// first build. Otherwise it watches the served directories created since.
+func (gw *genWatcher) update() {
+	root, err := filepath.EvalSymlinks(gw.gpf.dirs.GenfilesDir)
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	first := !gw.updated
+	gw.updated = true
+	if err != nil {
+		return
+	}
+	if root == gw.root {
+		for rel := range gw.served {
+			gw.watch(rel)
+		}
+		return
+	}
+	if !first {
+		// The files in the new tree are unknown.
+		go gw.gpf.invalidateAll()
+	}
+	gw.root = root
+	gw.rewatch()
+}
+
+// serve watches the generated files of the package directory, relative to
+// the output tree, from now on.
+func (gw *genWatcher) serve(rel string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if _, ok := gw.served[rel]; ok {
+		return
+	}
+	gw.served[rel] = struct{}{}
+	if gw.root != "" {
+		gw.watch(rel)
+	}
+}
+
+// watch watches the served directory, or its closest existing parent to
+// learn when it's created. It returns the directory if it wasn't watched
+// before.
+//
+// must hold gw.mu
+func (gw *genWatcher) watch(rel string) string {
+	dir := filepath.Join(gw.root, rel)
+	for dir != gw.root {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	if _, ok := gw.watched[dir]; ok {
+		return ""
+	}
+	if err := notify.Watch(dir, gw.ch, notify.All); err != nil {
+		fmt.Printf("Failed to watch the generated files in %s, %v.\n", dir, err)
+		return ""
+	}
+	gw.watched[dir] = struct{}{}
+	return dir
+}
+
+// rewatch watches the served directories anew, and returns the watched
+// directories. The watches of removed directories are gone, but can't be
+// added again otherwise.
+//
+// must hold gw.mu
+func (gw *genWatcher) rewatch() []string {
+	if len(gw.watched) > 0 {
+		notify.Stop(gw.ch)
+	}
+	gw.watched = map[string]struct{}{}
+	dirs := []string{}
+	for rel := range gw.served {
+		if dir := gw.watch(rel); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func (gw *genWatcher) run() {
+	overflowed := false
+	for ei := range gw.ch {
+		if len(gw.ch) >= cap(gw.ch)-1 {
+			overflowed = true
+		}
+
+		gw.mu.Lock()
+		root := gw.root
+		created := gw.updateWatches(ei)
+		gw.mu.Unlock()
+
+		if root != "" && strings.HasPrefix(ei.Path(), root+pathSeparator) {
+			gw.notify(ei.Event(), ei.Path()[len(root+pathSeparator):])
+		}
+		// The files changed before the directories were watched.
+		for _, dir := range created {
+			fis, _ := ioutil.ReadDir(dir)
+			for _, fi := range fis {
+				gw.notify(notify.Create, filepath.Join(dir, fi.Name())[len(root+pathSeparator):])
+			}
+		}
+
+		// Events were dropped, e.g., by a large build.
+		if overflowed && len(gw.ch) == 0 {
+			overflowed = false
+			gw.gpf.invalidateAll()
+		}
+	}
+}
+
+// updateWatches follows the served directories being removed or created.
+// It returns the directories it started to watch, whose files may have been
+// created meanwhile.
+//
+// must hold gw.mu
+func (gw *genWatcher) updateWatches(ei notify.EventInfo) []string {
+	path := ei.Path()
+	switch ei.Event() {
+	case notify.Remove, notify.Rename:
+		if _, ok := gw.watched[path]; ok {
+			return gw.rewatch()
+		}
+	case notify.Create:
+		if fi, err := os.Stat(path); err != nil || !fi.IsDir() || !strings.HasPrefix(path, gw.root+pathSeparator) {
+			return nil
+		}
+		rel := path[len(gw.root+pathSeparator):]
+		created := []string{}
+		for served := range gw.served {
+			if served == rel || strings.HasPrefix(served, rel+pathSeparator) {
+				if dir := gw.watch(served); dir != "" {
+					created = append(created, dir)
+				}
+			}
+		}
+		return created
+	}
+	return nil
+}
+
+func (gw *genWatcher) notify(event notify.Event, rel string) {
+	if gw.gpf.snapshot != nil {
+		// Snapshots are switched and invalidated after builds, they only
+		// have the .go files.
+		gw.gpf.snapshot.changed()
+		if strings.HasSuffix(rel, ".go") {
+			return
+		}
+	}
+	gw.gpf.invalidate(event, fromGenfiles, rel)
+}
+
+func (gw *genWatcher) stop() {
+	notify.Stop(gw.ch)
+}
+
+func newGenWatcher(gpf *GoPathFs) *genWatcher {
+	return &genWatcher{
+		gpf:     gpf,
+		ch:      make(chan notify.EventInfo, notifyChSize),
+		served:  map[string]struct{}{},
+		watched: map[string]struct{}{},
+	}
+}
@@ -8,96 +8,166 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/linuxerwang/gobazel/bep"
 	"github.com/linuxerwang/gobazel/conf"
 	"github.com/linuxerwang/gobazel/exec"
+	"github.com/linuxerwang/gobazel/hooks"
+	"github.com/linuxerwang/gobazel/pathmap"
 	"github.com/rjeczalik/notify"
 )
 
+const (
+	notifyChSize = 4096
+)
+
 var (
 	pathSeparator = string(os.PathSeparator)
 )
 
 // Dirs contains directory paths for GoPathFs.
 type Dirs struct {
-	Workspace string
-	GobzlConf string
-	GobzlPid  string
-	BinDir    string
-	PkgDir    string
-	SrcDir    string
-	GoSDKDir  string
+	Workspace   string
+	GobzlConf   string
+	GobzlPid    string
+	BinDir      string
+	PkgDir      string
+	SrcDir      string
+	StateDir    string
+	GenfilesDir string
+	GoSDKDir    string
 }
 
 // GoPathFs implements a virtual tree for src folder of GOPATH.
 type GoPathFs struct {
-	pathfs.FileSystem
 	debug         bool
 	dirs          *Dirs
 	cfg           *conf.GobazelConf
 	ignoreRegexes []*regexp.Regexp
 	notifyCh      chan notify.EventInfo
+	events        *eventQueue
+	bazel         *exec.Bazel
+	hooks         *hooks.Runner
+	lazyGen       *lazyGen
+	snapshot      *genSnapshot
+	genWatcher    *genWatcher
+	index         *pathIndex
+	inodes        *inodeTable
+	notifier      notifier
 }
 
-// Access overwrites the parent's Access method.
-func (gpf *GoPathFs) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.OK
-}
-
-// OnMount overwrites the parent's OnMount method.
-func (gpf *GoPathFs) OnMount(nodeFs *pathfs.PathNodeFs) {
+// OnMount indexes the virtual tree and watches the changes of the real
+// trees. It's called once the kernel mounted the tree, the changes can't be
+// notified before.
+func (gpf *GoPathFs) OnMount() {
+	go gpf.index.build()
 	if err := notify.Watch(filepath.Join(gpf.dirs.Workspace, "..."), gpf.notifyCh, notify.All); err != nil {
 		log.Fatal(err)
 	}
 
+	// The output tree moves when bazel recreates it.
+	gpf.genWatcher.update()
+	gpf.bazel.OnBuildsDone(gpf.genWatcher.update)
+	go gpf.genWatcher.run()
+
+	if gpf.snapshot != nil {
+		go gpf.snapshot.watch()
+	}
+
+	go gpf.hooks.Scan()
+	gpf.bazel.TrackQueries()
+	go gpf.events.fill(gpf.notifyCh)
 	go func() {
-		for ei := range gpf.notifyCh {
-			path := ei.Path()[len(gpf.dirs.Workspace+pathSeparator):]
-			gpf.notifyFileChange(nodeFs, path)
+		for {
+			events, overflow := gpf.events.take()
+			if overflow {
+				// The hooks have to rescan the changed files.
+				gpf.bazel.ResetQueries()
+				gpf.hooks.Overflow()
+			}
+
+			changes := make([]fileChange, 0, len(events))
+			for _, ei := range events {
+				if !strings.HasPrefix(ei.Path(), gpf.dirs.Workspace+pathSeparator) {
+					// E.g., the workspace directory itself.
+					continue
+				}
+				path := ei.Path()[len(gpf.dirs.Workspace+pathSeparator):]
+				if strings.HasPrefix(path, "bazel-") && !strings.Contains(path, pathSeparator) {
+					// The convenience symlinks changed.
+					gpf.genWatcher.update()
+				}
+				if !gpf.skipped(path) {
+					changes = append(changes, fileChange{event: ei.Event(), from: fromWorkspace, rel: path})
+				}
+			}
+			gpf.notifyFileChanges(changes)
+
+			// The kernel may cache anything for the configured timeouts,
+			// so forget it all.
+			if overflow {
+				gpf.invalidateAll()
+			}
 		}
 	}()
 }
 
-// OnUnmount overwrites the parent's OnUnmount method.
+// OnUnmount stops watching the real trees and running hooks.
 func (gpf *GoPathFs) OnUnmount() {
 	notify.Stop(gpf.notifyCh)
+	gpf.genWatcher.stop()
+	gpf.hooks.Stop()
 }
 
-func (gpf *GoPathFs) notifyFileChange(nodeFs *pathfs.PathNodeFs, path string) {
-	if gpf.isIgnored(path) {
-		return
-	}
+func (gpf *GoPathFs) notifyFileChanges(changes []fileChange) {
+	gpf.invalidateChanges(changes)
 
-	if strings.HasSuffix(path, pathSeparator+".git") || strings.Contains(path, pathSeparator+".git"+pathSeparator) {
-		return
+	// Queue the configured hooks, e.g., bazel build for proto files.
+	for _, c := range changes {
+		if kind := eventKind(c.event); kind != "" {
+			gpf.bazel.InvalidateQueries(kind, c.rel)
+			gpf.hooks.Add(kind, c.rel)
+		}
 	}
+}
 
-	go nodeFs.Notify(filepath.Join(gpf.cfg.GoPkgPrefix, path))
-
-	isVendor := false
-	for _, vendor := range gpf.cfg.Vendors {
-		if strings.HasPrefix(path, vendor+pathSeparator) {
-			isVendor = true
-			nodeFs.FileNotify(path[len(vendor+pathSeparator):], 0, 0)
-			break
-		}
+// skipped reports whether the changes of the workspace relative path are
+// ignored.
+func (gpf *GoPathFs) skipped(path string) bool {
+	if gpf.isIgnored(path) {
+		return true
 	}
+	return path == ".git" || strings.HasSuffix(path, pathSeparator+".git") || strings.Contains(path, pathSeparator+".git"+pathSeparator)
+}
 
-	// If it's a proto file, run bazel build.
-	if strings.HasSuffix(path, ".proto") {
-		bzlPkg := filepath.Dir(path) + ":*"
-		exec.RunBazelBuild(gpf.dirs.Workspace, bzlPkg)
+func eventKind(event notify.Event) string {
+	switch event {
+	case notify.Create:
+		return "create"
+	case notify.Write:
+		return "write"
+	case notify.Remove:
+		return "remove"
+	case notify.Rename:
+		return "rename"
 	}
+	return ""
+}
 
-	// Run go install.
-	if strings.HasSuffix(path, ".proto") || strings.HasSuffix(path, ".go") {
-		goPkg := filepath.Dir(path)
-		if !isVendor {
-			goPkg = filepath.Join(gpf.cfg.GoPkgPrefix, goPkg)
-		}
-		exec.RunGoInstall(gpf.cfg, goPkg)
+// genDirs returns the real directories of the generated files at the
+// relative path. A snapshot only serves the .go files, the others come from
+// the output tree.
+func (gpf *GoPathFs) genDirs(rel string) []realDir {
+	live := realDir{path: filepath.Join(gpf.dirs.GenfilesDir, rel), generated: true}
+	if gpf.snapshot == nil {
+		return []realDir{live}
+	}
+	dir := gpf.snapshot.Dir()
+	if dir == gpf.dirs.GenfilesDir {
+		// No snapshot was taken yet.
+		return []realDir{live}
 	}
+	live.noGo = true
+	return []realDir{{path: filepath.Join(dir, rel), generated: true}, live}
 }
 
 func (gpf *GoPathFs) isIgnored(dir string) bool {
@@ -133,32 +203,55 @@ func NewGoPathFs(debug bool, cfg *conf.GobazelConf, dirs *Dirs) *GoPathFs {
 	}
 
 	gpfs := GoPathFs{
-		FileSystem:    pathfs.NewDefaultFileSystem(),
 		debug:         debug,
 		dirs:          dirs,
 		cfg:           cfg,
 		ignoreRegexes: ignoreRegexes,
-		notifyCh:      make(chan notify.EventInfo, 10),
+		notifyCh:      make(chan notify.EventInfo, notifyChSize),
+		events:        newEventQueue(),
 	}
 
 	// Find the go-sdk in bazel external folder. The debugger can use the same
 	// go-sdk source code for debugging.
-	found := false
-	if fi, err := os.Lstat("bazel-out"); err == nil {
-		if fi.Mode()&os.ModeSymlink != 0 {
-			if target, err := os.Readlink("bazel-out"); err == nil {
-				target = filepath.ToSlash(target)
-				suffix := filepath.Join("execroot", "__main__", "bazel-out")
-				if strings.HasSuffix(target, suffix) {
-					gpfs.dirs.GoSDKDir = filepath.Join(target[:len(target)-len(suffix)], "external", "go_sdk")
-					found = true
-				}
-			}
-		}
-	}
-	if !found {
+	if sdkDir, ok := FindGoSDKDir(dirs.Workspace); ok {
+		gpfs.dirs.GoSDKDir = sdkDir
+	} else {
 		fmt.Println("Could not find symbolic link \"bazel-out\", debugger will not find Go SDK source codes.")
 	}
 
+	// Record the results of background builds for editors.
+	rw := pathmap.NewRewriter(pathmap.New(cfg, dirs.Workspace, dirs.SrcDir), dirs.GoSDKDir)
+	gpfs.bazel = exec.NewBazel(cfg, dirs.Workspace, dirs.StateDir, bep.NewRecorder(dirs.StateDir, rw))
+	gpfs.hooks = hooks.NewRunner(cfg, dirs.Workspace, dirs.SrcDir, dirs.StateDir, gpfs.bazel, gpfs.skipped)
+	gpfs.lazyGen = newLazyGen(&gpfs)
+	gpfs.genWatcher = newGenWatcher(&gpfs)
+	gpfs.index = newPathIndex(&gpfs)
+	gpfs.inodes = newInodeTable()
+	if cfg.SnapshotGen {
+		gpfs.snapshot = newGenSnapshot(&gpfs)
+	}
+
 	return &gpfs
 }
+
+// FindGoSDKDir finds the go-sdk in bazel external folder through the
+// "bazel-out" symbolic link in the given workspace.
+func FindGoSDKDir(workspace string) (string, bool) {
+	link := filepath.Join(workspace, "bazel-out")
+	fi, err := os.Lstat(link)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", false
+	}
+
+	target = filepath.ToSlash(target)
+	suffix := filepath.Join("execroot", "__main__", "bazel-out")
+	if !strings.HasSuffix(target, suffix) {
+		return "", false
+	}
+	return filepath.Join(target[:len(target)-len(suffix)], "external", "go_sdk"), true
+}
@@ -0,0 +1,398 @@
+package gopathfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/linuxerwang/gobazel/conf"
+)
+
+// testTree is a workspace with its generated files and a GOPATH to mount
+// the virtual tree in.
+type testTree struct {
+	gpf *GoPathFs
+	ws  string
+	gen string
+	src string
+}
+
+// newTestTree returns a GoPathFs with the prefix "p.com", vendor directory
+// "third_party" and fall-through directory "ft", and a package "a" in the
+// workspace and generated files.
+func newTestTree(t *testing.T) *testTree {
+	d, err := ioutil.TempDir("", "gopathfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(d) })
+
+	tt := testTree{
+		ws:  filepath.Join(d, "ws"),
+		gen: filepath.Join(d, "gen"),
+		src: filepath.Join(d, "gopath", "src"),
+	}
+	for _, dir := range []string{
+		filepath.Join(tt.ws, "a"),
+		filepath.Join(tt.ws, "ft", "sub"),
+		filepath.Join(tt.ws, "third_party", "github.com", "x"),
+		filepath.Join(tt.gen, "a"),
+		filepath.Join(d, "gopath", ".gobazel"),
+		tt.src,
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(tt.ws, "a", "a.go"), "a")
+	writeFile(t, filepath.Join(tt.gen, "a", "a.pb.go"), "pb")
+	writeFile(t, filepath.Join(tt.ws, "ft", "sub", "f"), "f")
+	writeFile(t, filepath.Join(tt.ws, "third_party", "github.com", "x", "x.go"), "x")
+	if err := os.Symlink(tt.gen, filepath.Join(tt.ws, "bazel-genfiles")); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &conf.GobazelConf{
+		GoPkgPrefix:    "p.com",
+		Vendors:        []string{"third_party"},
+		FallThrough:    []string{"ft"},
+		IgnoreSet:      map[string]struct{}{},
+		VendorSet:      map[string]struct{}{"third_party": {}},
+		FallThroughSet: map[string]struct{}{"ft": {}},
+	}
+	dirs := Dirs{
+		Workspace:   tt.ws,
+		SrcDir:      tt.src,
+		StateDir:    filepath.Join(d, "gopath", ".gobazel"),
+		GenfilesDir: filepath.Join(tt.ws, "bazel-genfiles"),
+	}
+	tt.gpf = NewGoPathFs(false, cfg, &dirs)
+	return &tt
+}
+
+// mount mounts the virtual tree on the GOPATH src directory, with kernel
+// caches which only changes invalidate. The test is skipped if FUSE isn't
+// available.
+func (tt *testTree) mount(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("FUSE isn't available")
+	}
+
+	timeout := time.Hour
+	opts := fs.Options{
+		EntryTimeout:    &timeout,
+		AttrTimeout:     &timeout,
+		NegativeTimeout: &timeout,
+		RootStableAttr:  &fs.StableAttr{Ino: 1},
+	}
+	opts.DirectMount = true
+	server, err := fuse.NewServer(fs.NewNodeFS(NewRoot(tt.gpf), &opts), tt.src, &opts.MountOptions)
+	if err != nil {
+		t.Skipf("Failed to mount, %v", err)
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	tt.gpf.OnMount()
+	t.Cleanup(func() {
+		server.Unmount()
+		tt.gpf.OnUnmount()
+	})
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventually retries check until it succeeds, or fails the test after a
+// while. Changes of the real trees reach the mount asynchronously.
+func eventually(t *testing.T, what string, check func() error) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %v", what, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func hasContent(path, want string) func() error {
+	return func() error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if string(b) != want {
+			return fmt.Errorf("%s has %q, want %q", path, b, want)
+		}
+		return nil
+	}
+}
+
+func isMissing(path string) func() error {
+	return func() error {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return fmt.Errorf("%s exists, err %v", path, err)
+		}
+		return nil
+	}
+}
+
+func hasNames(dir string, want ...string) func() error {
+	return func() error {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		names := []string{}
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		sort.Strings(want)
+		if fmt.Sprint(names) != fmt.Sprint(want) {
+			return fmt.Errorf("%s has %v, want %v", dir, names, want)
+		}
+		return nil
+	}
+}
+
+// testExternalChanges creates, changes, renames and deletes a file in the
+// real directory, and checks the virtual directory shows it.
+func testExternalChanges(t *testing.T, real, virtual string, names ...string) {
+	eventually(t, "initial listing", hasNames(virtual, names...))
+
+	writeFile(t, filepath.Join(real, "new.go"), "new")
+	eventually(t, "created", hasContent(filepath.Join(virtual, "new.go"), "new"))
+	eventually(t, "created listing", hasNames(virtual, append(names, "new.go")...))
+
+	writeFile(t, filepath.Join(real, "new.go"), "changed")
+	eventually(t, "changed", hasContent(filepath.Join(virtual, "new.go"), "changed"))
+
+	if err := os.Rename(filepath.Join(real, "new.go"), filepath.Join(real, "renamed.go")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "renamed from", isMissing(filepath.Join(virtual, "new.go")))
+	eventually(t, "renamed to", hasContent(filepath.Join(virtual, "renamed.go"), "changed"))
+
+	if err := os.Remove(filepath.Join(real, "renamed.go")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deleted", isMissing(filepath.Join(virtual, "renamed.go")))
+	eventually(t, "deleted listing", hasNames(virtual, names...))
+}
+
+// testMountChanges creates, renames and deletes a file through the virtual
+// directory, and checks the real directory has the changes.
+func testMountChanges(t *testing.T, real, virtual string) {
+	writeFile(t, filepath.Join(virtual, "mnt.go"), "mnt")
+	eventually(t, "created", hasContent(filepath.Join(real, "mnt.go"), "mnt"))
+
+	if err := os.Rename(filepath.Join(virtual, "mnt.go"), filepath.Join(virtual, "moved.go")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "renamed from", isMissing(filepath.Join(real, "mnt.go")))
+	eventually(t, "renamed to", hasContent(filepath.Join(real, "moved.go"), "mnt"))
+	eventually(t, "renamed in the mount", hasContent(filepath.Join(virtual, "moved.go"), "mnt"))
+
+	if err := os.Remove(filepath.Join(virtual, "moved.go")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deleted", isMissing(filepath.Join(real, "moved.go")))
+	eventually(t, "deleted in the mount", isMissing(filepath.Join(virtual, "moved.go")))
+}
+
+func TestMountWorkspace(t *testing.T) {
+	tt := newTestTree(t)
+	tt.mount(t)
+
+	real, virtual := filepath.Join(tt.ws, "a"), filepath.Join(tt.src, "p.com", "a")
+	testExternalChanges(t, real, virtual, "a.go", "a.pb.go")
+	testMountChanges(t, real, virtual)
+}
+
+func TestMountGenfiles(t *testing.T) {
+	tt := newTestTree(t)
+	tt.mount(t)
+
+	virtual := filepath.Join(tt.src, "p.com", "a")
+	testExternalChanges(t, filepath.Join(tt.gen, "a"), virtual, "a.go", "a.pb.go")
+
+	// The workspace overrides the generated files.
+	writeFile(t, filepath.Join(tt.ws, "a", "a.pb.go"), "ws")
+	eventually(t, "overridden", hasContent(filepath.Join(virtual, "a.pb.go"), "ws"))
+	if err := os.Remove(filepath.Join(tt.ws, "a", "a.pb.go")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "generated again", hasContent(filepath.Join(virtual, "a.pb.go"), "pb"))
+}
+
+func TestMountGenfilesCreated(t *testing.T) {
+	tt := newTestTree(t)
+	if err := os.Mkdir(filepath.Join(tt.ws, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tt.ws, "b", "b.go"), "b")
+	tt.mount(t)
+
+	// The package is watched before its generated files exist.
+	virtual := filepath.Join(tt.src, "p.com", "b")
+	eventually(t, "initial listing", hasNames(virtual, "b.go"))
+	if err := os.MkdirAll(filepath.Join(tt.gen, "b", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tt.gen, "b", "b.pb.go"), "pb")
+	eventually(t, "generated", hasNames(virtual, "b.go", "b.pb.go", "sub"))
+
+	// And after they were deleted and generated again.
+	if err := os.RemoveAll(filepath.Join(tt.gen, "b")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deleted", hasNames(virtual, "b.go"))
+	if err := os.Mkdir(filepath.Join(tt.gen, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tt.gen, "b", "b.pb.go"), "pb again")
+	eventually(t, "generated again", hasContent(filepath.Join(virtual, "b.pb.go"), "pb again"))
+}
+
+func TestMountSnapshot(t *testing.T) {
+	tt := newTestTree(t)
+	writeFile(t, filepath.Join(tt.gen, "a", "a.txt"), "txt")
+	tt.gpf.snapshot = newGenSnapshot(tt.gpf)
+	tt.gpf.snapshot.refresh()
+	tt.mount(t)
+
+	virtual := filepath.Join(tt.src, "p.com", "a")
+	eventually(t, "initial listing", hasNames(virtual, "a.go", "a.pb.go", "a.txt"))
+
+	// The .go files are served from the snapshot, the others from the output
+	// tree.
+	if err := os.Remove(filepath.Join(tt.gen, "a", "a.pb.go")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tt.gen, "a", "a.pb.go"), "rebuilt")
+	writeFile(t, filepath.Join(tt.gen, "a", "b.pb.go"), "b")
+	writeFile(t, filepath.Join(tt.gen, "a", "a.txt"), "changed")
+	eventually(t, "changed output", hasContent(filepath.Join(virtual, "a.txt"), "changed"))
+	if err := hasContent(filepath.Join(virtual, "a.pb.go"), "pb")(); err != nil {
+		t.Errorf("before the refresh: %v", err)
+	}
+	if err := hasNames(virtual, "a.go", "a.pb.go", "a.txt")(); err != nil {
+		t.Errorf("before the refresh: %v", err)
+	}
+
+	tt.gpf.snapshot.refresh()
+	eventually(t, "refreshed", hasContent(filepath.Join(virtual, "a.pb.go"), "rebuilt"))
+	eventually(t, "refreshed listing", hasNames(virtual, "a.go", "a.pb.go", "a.txt", "b.pb.go"))
+}
+
+func TestMountVendor(t *testing.T) {
+	tt := newTestTree(t)
+	tt.mount(t)
+
+	real := filepath.Join(tt.ws, "third_party", "github.com", "x")
+	virtual := filepath.Join(tt.src, "github.com", "x")
+	testExternalChanges(t, real, virtual, "x.go")
+	testMountChanges(t, real, virtual)
+}
+
+func TestMountRenameAcross(t *testing.T) {
+	tt := newTestTree(t)
+	tt.mount(t)
+
+	// Files move between the workspace and the vendor directories on the
+	// same device.
+	from := filepath.Join(tt.src, "p.com", "a", "a.go")
+	to := filepath.Join(tt.src, "github.com", "x", "a.go")
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "renamed from", isMissing(filepath.Join(tt.ws, "a", "a.go")))
+	eventually(t, "renamed to", hasContent(filepath.Join(tt.ws, "third_party", "github.com", "x", "a.go"), "a"))
+	eventually(t, "renamed in the mount", hasContent(to, "a"))
+	eventually(t, "renamed from in the mount", isMissing(from))
+
+	if err := os.Rename(to, from); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "renamed back", hasContent(filepath.Join(tt.ws, "a", "a.go"), "a"))
+	eventually(t, "renamed back in the mount", hasContent(from, "a"))
+}
+
+func TestMountFallThrough(t *testing.T) {
+	tt := newTestTree(t)
+	tt.mount(t)
+
+	real, virtual := filepath.Join(tt.ws, "ft", "sub"), filepath.Join(tt.src, "ft", "sub")
+	testExternalChanges(t, real, virtual, "f")
+	testMountChanges(t, real, virtual)
+}
+
+func TestMountTopDir(t *testing.T) {
+	tt := newTestTree(t)
+	tt.mount(t)
+
+	eventually(t, "top listing", hasNames(tt.src, "p.com", "github.com", "ft"))
+
+	// New vendored repositories show up at the top.
+	if err := os.MkdirAll(filepath.Join(tt.ws, "third_party", "golang.org"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "vendor created", hasNames(tt.src, "p.com", "github.com", "golang.org", "ft"))
+	if err := os.Remove(filepath.Join(tt.ws, "third_party", "golang.org")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "vendor deleted", hasNames(tt.src, "p.com", "github.com", "ft"))
+}
+
+func TestMountInodes(t *testing.T) {
+	tt := newTestTree(t)
+	tt.mount(t)
+
+	ino := func(path string) uint64 {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Sys().(*syscall.Stat_t).Ino
+	}
+
+	virtual := filepath.Join(tt.src, "p.com", "a", "a.go")
+	want := ino(virtual)
+
+	// Replaced files keep their number, like an editor saving them.
+	writeFile(t, filepath.Join(tt.ws, "a", "a.go.tmp"), "saved")
+	if err := os.Rename(filepath.Join(tt.ws, "a", "a.go.tmp"), filepath.Join(tt.ws, "a", "a.go")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "replaced", hasContent(virtual, "saved"))
+	if got := ino(virtual); got != want {
+		t.Errorf("inode of the replaced file is %d, want %d", got, want)
+	}
+
+	// So do deleted and created ones.
+	if err := os.Remove(virtual); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, virtual, "created")
+	if got := ino(virtual); got != want {
+		t.Errorf("inode of the created file is %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,292 @@
+package gopathfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// realDir is a real directory backing a virtual directory.
+type realDir struct {
+	path      string
+	generated bool
+	// noGo skips the .go files, which a snapshot serves.
+	noGo bool
+}
+
+// serves reports whether the real directory provides its entry of the name.
+func (rd realDir) serves(name string, dir bool) bool {
+	return dir || !rd.noGo || !strings.HasSuffix(name, ".go")
+}
+
+// indexChild routes a name in a virtual directory to the real directory
+// providing it.
+type indexChild struct {
+	slot int
+	dir  bool
+}
+
+// indexDir is an indexed virtual directory.
+type indexDir struct {
+	entries  []fuse.DirEntry
+	status   fuse.Status
+	children map[string]indexChild
+}
+
+// pathIndex is an in-memory index of the merged virtual tree. It caches the
+// listings of the virtual directories and which real directory provides each
+// name, so lookups don't search the candidate directories one by one. The
+// real paths are derived from the routes, thus switching the generated files
+// directory doesn't invalidate them. Directories which aren't indexed (e.g.,
+// GOROOT or ignored directories) are resolved as before.
+type pathIndex struct {
+	gpf *GoPathFs
+
+	mu   sync.RWMutex
+	dirs map[string]*indexDir
+}
+
+// route returns the real path of the virtual path and true if its
+// directory is indexed. The real path is empty if the name doesn't exist.
+// Names missing in the index are looked up in the real directories.
+func (ix *pathIndex) route(name string) (string, bool) {
+	dir, base := ix.split(name)
+	if dir == "" || ix.gpf.isGoRoot(name) {
+		// The top level names are resolved without searching.
+		return "", false
+	}
+
+	ix.mu.RLock()
+	d, ok := ix.dirs[dir]
+	var child indexChild
+	var found bool
+	if ok {
+		child, found = d.children[base]
+	}
+	ix.mu.RUnlock()
+
+	if !ok {
+		return "", false
+	}
+	if !found {
+		// The name may be created before the index learns about it, e.g.,
+		// while its event is queued.
+		for _, rd := range ix.gpf.realDirs(dir) {
+			real := filepath.Join(rd.path, base)
+			if fi, err := os.Lstat(real); err == nil && rd.serves(base, fi.IsDir()) {
+				return real, true
+			}
+		}
+		return "", true
+	}
+	return filepath.Join(ix.gpf.realDirs(dir)[child.slot].path, base), true
+}
+
+// listing returns the cached listing of the virtual directory and true if
+// it's indexed.
+func (ix *pathIndex) listing(name string) ([]fuse.DirEntry, fuse.Status, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	d, ok := ix.dirs[name]
+	if !ok {
+		return nil, fuse.OK, false
+	}
+	return d.entries, d.status, true
+}
+
+// build indexes the virtual tree.
+func (ix *pathIndex) build() {
+	start := time.Now()
+	ix.index("")
+	ix.index(ix.gpf.cfg.GoPkgPrefix)
+	for _, dir := range ix.gpf.cfg.FallThrough {
+		ix.index(dir)
+	}
+
+	ix.mu.RLock()
+	n := len(ix.dirs)
+	ix.mu.RUnlock()
+	fmt.Printf("Indexed %d directories in %v.\n", n, time.Since(start))
+}
+
+// index indexes the virtual directory and its subdirectories, unless they
+// were indexed meanwhile.
+func (ix *pathIndex) index(name string) {
+	d := ix.scan(name)
+
+	ix.mu.Lock()
+	if _, ok := ix.dirs[name]; !ok {
+		ix.dirs[name] = d
+	}
+	ix.mu.Unlock()
+
+	for base, child := range d.children {
+		if child.dir && ix.descend(name, base, child) {
+			ix.index(filepath.Join(name, base))
+		}
+	}
+}
+
+// reset drops the index and builds it again.
+func (ix *pathIndex) reset() {
+	ix.mu.Lock()
+	ix.dirs = map[string]*indexDir{}
+	ix.mu.Unlock()
+
+	go ix.build()
+}
+
+// refresh scans the virtual directory again, if it's indexed.
+func (ix *pathIndex) refresh(name string) {
+	ix.mu.RLock()
+	_, ok := ix.dirs[name]
+	ix.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	d := ix.scan(name)
+	ix.mu.Lock()
+	ix.dirs[name] = d
+	ix.mu.Unlock()
+}
+
+// changed updates the index for the changed virtual paths. Each of their
+// directories is scanned once.
+func (ix *pathIndex) changed(names ...string) {
+	dirs := map[string]map[string]struct{}{}
+	for _, name := range names {
+		dir, base := ix.split(name)
+		if dirs[dir] == nil {
+			dirs[dir] = map[string]struct{}{}
+		}
+		dirs[dir][base] = struct{}{}
+	}
+	for dir, bases := range dirs {
+		ix.changedDir(dir, bases)
+	}
+}
+
+// changedDir updates the index for the changed names of the virtual
+// directory.
+func (ix *pathIndex) changedDir(dir string, bases map[string]struct{}) {
+	ix.mu.RLock()
+	_, ok := ix.dirs[dir]
+	ix.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	d := ix.scan(dir)
+	added := []string{}
+	ix.mu.Lock()
+	old, ok := ix.dirs[dir]
+	for base := range bases {
+		name := filepath.Join(dir, base)
+		if ok {
+			if oc, found := old.children[base]; found && oc.dir {
+				if nc, found := d.children[base]; !found || !nc.dir || nc.slot != oc.slot {
+					ix.drop(name)
+				}
+			}
+		}
+		if _, indexed := ix.dirs[name]; indexed {
+			continue
+		}
+		if child, ok := d.children[base]; ok && child.dir && ix.descend(dir, base, child) {
+			added = append(added, name)
+		}
+	}
+	ix.dirs[dir] = d
+	ix.mu.Unlock()
+
+	for _, name := range added {
+		ix.index(name)
+	}
+}
+
+// drop removes the virtual directory and its subdirectories from the index.
+// ix.mu must be held.
+func (ix *pathIndex) drop(name string) {
+	d, ok := ix.dirs[name]
+	if !ok {
+		return
+	}
+	delete(ix.dirs, name)
+	for base, child := range d.children {
+		if child.dir {
+			ix.drop(filepath.Join(name, base))
+		}
+	}
+}
+
+// scan lists the virtual directory and the real directories backing it.
+func (ix *pathIndex) scan(name string) *indexDir {
+	d := indexDir{
+		children: map[string]indexChild{},
+	}
+	n := ix.gpf.resolve(name)
+	d.entries, d.status = n.list()
+
+	for slot, rd := range n.realDirs() {
+		h, err := os.Open(rd.path)
+		if err != nil {
+			continue
+		}
+		fis, _ := h.Readdir(-1)
+		h.Close()
+
+		for _, fi := range fis {
+			if !rd.serves(fi.Name(), fi.IsDir()) {
+				continue
+			}
+			if _, ok := d.children[fi.Name()]; !ok {
+				d.children[fi.Name()] = indexChild{slot: slot, dir: fi.IsDir()}
+			}
+		}
+	}
+	return &d
+}
+
+// descend reports whether the subdirectory of the virtual directory is
+// indexed. Only source directories are, not the generated ones.
+func (ix *pathIndex) descend(dir, base string, child indexChild) bool {
+	if ix.gpf.isIgnored(base) || base == ".git" || ix.gpf.realDirs(dir)[child.slot].generated {
+		return false
+	}
+	if dir == ix.gpf.cfg.GoPkgPrefix && (base == "GOROOT" || ix.gpf.isVendorDir(base)) {
+		return false
+	}
+	return true
+}
+
+func (ix *pathIndex) split(name string) (string, string) {
+	dir, base := filepath.Dir(name), filepath.Base(name)
+	if dir == "." {
+		dir = ""
+	}
+	return dir, base
+}
+
+// realDirs returns the real directories backing the virtual directory, in
+// the order they are searched.
+func (gpf *GoPathFs) realDirs(name string) []realDir {
+	return gpf.resolve(name).realDirs()
+}
+
+func (gpf *GoPathFs) isGoRoot(name string) bool {
+	goroot := filepath.Join(gpf.cfg.GoPkgPrefix, "GOROOT")
+	return name == goroot || strings.HasPrefix(name, goroot+pathSeparator)
+}
+
+func newPathIndex(gpf *GoPathFs) *pathIndex {
+	return &pathIndex{
+		gpf:  gpf,
+		dirs: map[string]*indexDir{},
+	}
+}
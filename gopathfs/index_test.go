@@ -0,0 +1,110 @@
+package gopathfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathIndexChanged(t *testing.T) {
+	tt := newTestTree(t)
+	ix := tt.gpf.index
+	ix.build()
+
+	checkRoute := func(name, want string) {
+		t.Helper()
+		got, ok := ix.route(name)
+		if !ok {
+			t.Fatalf("route(%q) isn't indexed", name)
+		}
+		if got != want {
+			t.Errorf("route(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	checkRoute("p.com/a/a.go", filepath.Join(tt.ws, "a", "a.go"))
+	checkRoute("p.com/a/a.pb.go", filepath.Join(tt.ws, "bazel-genfiles", "a", "a.pb.go"))
+	checkRoute("p.com/a/b.go", "")
+
+	// Created files.
+	writeFile(t, filepath.Join(tt.ws, "a", "b.go"), "b")
+	ix.changed("p.com/a/b.go")
+	checkRoute("p.com/a/b.go", filepath.Join(tt.ws, "a", "b.go"))
+
+	// The workspace overrides the generated files.
+	writeFile(t, filepath.Join(tt.ws, "a", "a.pb.go"), "pb")
+	ix.changed("p.com/a/a.pb.go")
+	checkRoute("p.com/a/a.pb.go", filepath.Join(tt.ws, "a", "a.pb.go"))
+	if err := os.Remove(filepath.Join(tt.ws, "a", "a.pb.go")); err != nil {
+		t.Fatal(err)
+	}
+	ix.changed("p.com/a/a.pb.go")
+	checkRoute("p.com/a/a.pb.go", filepath.Join(tt.ws, "bazel-genfiles", "a", "a.pb.go"))
+
+	// Created directories are indexed with their contents.
+	if err := os.MkdirAll(filepath.Join(tt.ws, "a", "sub", "deep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tt.ws, "a", "sub", "deep", "c.go"), "c")
+	ix.changed("p.com/a/sub")
+	checkRoute("p.com/a/sub/deep/c.go", filepath.Join(tt.ws, "a", "sub", "deep", "c.go"))
+
+	// Deleted directories are dropped with their subdirectories.
+	if err := os.RemoveAll(filepath.Join(tt.ws, "a", "sub")); err != nil {
+		t.Fatal(err)
+	}
+	ix.changed("p.com/a/sub")
+	checkRoute("p.com/a/sub", "")
+	for _, name := range []string{"p.com/a/sub", "p.com/a/sub/deep"} {
+		if _, _, ok := ix.listing(name); ok {
+			t.Errorf("%s is still indexed", name)
+		}
+	}
+
+	// Directories of the generated files aren't indexed.
+	if err := os.MkdirAll(filepath.Join(tt.gen, "a", "gen"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ix.changed("p.com/a/gen")
+	checkRoute("p.com/a/gen", filepath.Join(tt.ws, "bazel-genfiles", "a", "gen"))
+	if _, _, ok := ix.listing("p.com/a/gen"); ok {
+		t.Error("p.com/a/gen is indexed")
+	}
+
+	// Changes in directories which aren't indexed are ignored.
+	ix.changed("p.com/a/gen/d.go")
+	if _, ok := ix.route("p.com/a/gen/d.go"); ok {
+		t.Error("p.com/a/gen/d.go is routed")
+	}
+}
+
+func TestPathIndexFallback(t *testing.T) {
+	tt := newTestTree(t)
+	ix := tt.gpf.index
+	ix.build()
+
+	// Names created before the index learns about them are found.
+	writeFile(t, filepath.Join(tt.ws, "a", "b.go"), "b")
+	writeFile(t, filepath.Join(tt.gen, "a", "b.pb.go"), "pb")
+	for name, want := range map[string]string{
+		"p.com/a/b.go":    filepath.Join(tt.ws, "a", "b.go"),
+		"p.com/a/b.pb.go": filepath.Join(tt.ws, "bazel-genfiles", "a", "b.pb.go"),
+		"p.com/a/c.go":    "",
+	} {
+		got, ok := ix.route(name)
+		if !ok {
+			t.Fatalf("route(%q) isn't indexed", name)
+		}
+		if got != want {
+			t.Errorf("route(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	// So are dangling symbolic links.
+	if err := os.Symlink("missing", filepath.Join(tt.ws, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ix.route("p.com/a/link"); got != filepath.Join(tt.ws, "a", "link") {
+		t.Errorf("route(%q) = %q, want the link", "p.com/a/link", got)
+	}
+}
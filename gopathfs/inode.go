@@ -0,0 +1,127 @@
+package gopathfs
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// inodeKey identifies an entry of the virtual tree.
+type inodeKey struct {
+	path string
+	dir  bool
+}
+
+// inodeTable assigns the inode numbers of the virtual tree. The numbers are
+// derived from the virtual paths rather than the real files, so an entry
+// keeps its number when it's looked up again or when bazel or an editor
+// replaces the real file, and two entries never share one, even if they
+// come from different real trees. Unless the hashes of two paths collide,
+// the numbers are the same on the next mount. Only the entries the kernel
+// knows, or which were renamed or collided, are kept in the table, the
+// others are derived again.
+type inodeTable struct {
+	mu   sync.Mutex
+	inos map[inodeKey]uint64
+	keys map[uint64]inodeKey
+	// owners are the nodes holding the numbers in the mounted tree.
+	owners map[uint64]*node
+}
+
+// ino returns the inode number of the entry, assigning it if needed.
+func (it *inodeTable) ino(key inodeKey) uint64 {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if ino, ok := it.inos[key]; ok {
+		return ino
+	}
+	ino := it.free(key)
+	it.inos[key] = ino
+	it.keys[ino] = key
+	return ino
+}
+
+// peek returns the inode number the entry has, or would get.
+func (it *inodeTable) peek(key inodeKey) uint64 {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if ino, ok := it.inos[key]; ok {
+		return ino
+	}
+	return it.free(key)
+}
+
+// move gives the inode number to the entry at the new path, after it's
+// renamed.
+func (it *inodeTable) move(ino uint64, key inodeKey) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if old, ok := it.keys[ino]; ok && it.inos[old] == ino {
+		delete(it.inos, old)
+	}
+	it.inos[key] = ino
+	it.keys[ino] = key
+}
+
+// own records the node holding the inode number, e.g., after a node of
+// another type replaced the previous one.
+func (it *inodeTable) own(ino uint64, owner *node) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.owners[ino] = owner
+}
+
+// forget releases the inode number after the kernel forgot the inode of
+// the node. Nodes which don't hold the number anymore release nothing, go-fuse
+// also forgets the nodes it replaces.
+func (it *inodeTable) forget(ino uint64, owner *node) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if o, ok := it.owners[ino]; ok && o != owner {
+		return
+	}
+	delete(it.owners, ino)
+	if key, ok := it.keys[ino]; ok {
+		delete(it.keys, ino)
+		if it.inos[key] == ino {
+			delete(it.inos, key)
+		}
+	}
+}
+
+// remove drops the entries of the deleted path. The kernel may still hold
+// the inode, so its number stays reserved until it's forgotten, but a new
+// entry at the path gets the same number.
+func (it *inodeTable) remove(path string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	for _, dir := range []bool{false, true} {
+		delete(it.inos, inodeKey{path: path, dir: dir})
+	}
+}
+
+// free returns the first number from the hash of the entry which isn't used
+// by another entry. The root has inode number 1, and go-fuse numbers its own
+// inodes from 1<<63 up. it.mu must be held.
+func (it *inodeTable) free(key inodeKey) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key.path))
+	if key.dir {
+		h.Write([]byte(pathSeparator))
+	}
+
+	ino := h.Sum64() &^ (1 << 63)
+	for {
+		if k, ok := it.keys[ino]; (!ok || k == key) && ino > 1 {
+			return ino
+		}
+		ino = (ino + 1) &^ (1 << 63)
+	}
+}
+
+func newInodeTable() *inodeTable {
+	return &inodeTable{
+		inos:   map[inodeKey]uint64{},
+		keys:   map[uint64]inodeKey{},
+		owners: map[uint64]*node{},
+	}
+}
@@ -0,0 +1,122 @@
+package gopathfs
+
+import (
+	"testing"
+)
+
+func TestInodeTable(t *testing.T) {
+	it := newInodeTable()
+	file := inodeKey{path: "p.com/a/a.go"}
+	dir := inodeKey{path: "p.com/a/a.go", dir: true}
+
+	ino := it.ino(file)
+	if ino <= 1 || ino&(1<<63) != 0 {
+		t.Fatalf("ino(%v) = %#x, out of range", file, ino)
+	}
+	if got := it.ino(file); got != ino {
+		t.Errorf("ino(%v) = %#x again, want %#x", file, got, ino)
+	}
+	if got := it.ino(dir); got == ino {
+		t.Errorf("ino(%v) = %#x, same as the file", dir, got)
+	}
+
+	// Numbers only depend on the path.
+	if got := newInodeTable().ino(file); got != ino {
+		t.Errorf("ino(%v) = %#x in a new table, want %#x", file, got, ino)
+	}
+
+	// Peeking doesn't assign.
+	other := inodeKey{path: "p.com/a/b.go"}
+	peeked := it.peek(other)
+	if _, ok := it.inos[other]; ok {
+		t.Errorf("peek(%v) assigned a number", other)
+	}
+	if got := it.ino(other); got != peeked {
+		t.Errorf("ino(%v) = %#x, peeked %#x", other, got, peeked)
+	}
+
+	// Renamed entries keep their numbers, the old path gets a new one.
+	moved := inodeKey{path: "p.com/a/c.go"}
+	it.move(ino, moved)
+	if got := it.ino(moved); got != ino {
+		t.Errorf("ino(%v) = %#x after move, want %#x", moved, got, ino)
+	}
+	if got := it.ino(file); got == ino {
+		t.Errorf("ino(%v) = %#x after move, still the moved number", file, got)
+	}
+}
+
+func TestInodeTableCollision(t *testing.T) {
+	it := newInodeTable()
+	a := inodeKey{path: "a"}
+	b := inodeKey{path: "b"}
+
+	// Make b's number taken by a.
+	ino := it.peek(b)
+	it.move(ino, a)
+
+	got := it.ino(b)
+	if got == ino || got <= 1 || got&(1<<63) != 0 {
+		t.Errorf("ino(%v) = %#x, want a free number other than %#x", b, got, ino)
+	}
+	if got := it.ino(a); got != ino {
+		t.Errorf("ino(%v) = %#x, want %#x", a, got, ino)
+	}
+}
+
+func TestInodeTableRelease(t *testing.T) {
+	it := newInodeTable()
+	file := inodeKey{path: "p.com/a/a.go"}
+	ino := it.ino(file)
+
+	// A deleted path gets its number back when it's created anew.
+	it.remove(file.path)
+	if _, ok := it.inos[file]; ok {
+		t.Errorf("%v is still in the table after remove", file)
+	}
+	if got := it.ino(file); got != ino {
+		t.Errorf("ino(%v) = %#x after remove, want %#x", file, got, ino)
+	}
+
+	// Forgotten entries are dropped, and derived again.
+	it.forget(ino, nil)
+	if len(it.inos) != 0 || len(it.keys) != 0 {
+		t.Errorf("table has %v and %v after forget, want none", it.inos, it.keys)
+	}
+	if got := it.ino(file); got != ino {
+		t.Errorf("ino(%v) = %#x after forget, want %#x", file, got, ino)
+	}
+
+	// Renamed entries get their own number once forgotten.
+	moved := inodeKey{path: "p.com/a/c.go"}
+	want := it.peek(moved)
+	it.move(ino, moved)
+	it.forget(ino, nil)
+	if len(it.inos) != 0 || len(it.keys) != 0 {
+		t.Errorf("table has %v and %v after forget, want none", it.inos, it.keys)
+	}
+	if got := it.ino(moved); got != want {
+		t.Errorf("ino(%v) = %#x after forget, want %#x", moved, got, want)
+	}
+}
+
+func TestInodeTableOwner(t *testing.T) {
+	it := newInodeTable()
+	file := inodeKey{path: "p.com/a/a.go"}
+	ino := it.ino(file)
+	old, replaced := &node{}, &node{}
+	it.own(ino, old)
+
+	// The node replacing another one keeps the number when go-fuse forgets
+	// the replaced node.
+	it.own(ino, replaced)
+	it.forget(ino, old)
+	if got, ok := it.inos[file]; !ok || got != ino {
+		t.Errorf("%v has %#x, %v after the replaced node was forgotten, want %#x", file, got, ok, ino)
+	}
+
+	it.forget(ino, replaced)
+	if len(it.inos) != 0 || len(it.keys) != 0 || len(it.owners) != 0 {
+		t.Errorf("table has %v, %v and %v after forget, want none", it.inos, it.keys, it.owners)
+	}
+}
@@ -0,0 +1,145 @@
+package gopathfs
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rjeczalik/notify"
+)
+
+// origin is the real tree a changed path belongs to.
+type origin int
+
+const (
+	fromWorkspace origin = iota
+	fromGenfiles
+	fromGoSDK
+)
+
+// fileChange is an event of a path, relative to its real tree.
+type fileChange struct {
+	event notify.Event
+	from  origin
+	rel   string
+}
+
+// virtualPaths returns the paths in the virtual tree under which the given
+// path, relative to its real tree, is visible.
+func (gpf *GoPathFs) virtualPaths(from origin, rel string) []string {
+	if from == fromGoSDK {
+		return []string{filepath.Join(gpf.cfg.GoPkgPrefix, "GOROOT", rel)}
+	}
+
+	if from == fromWorkspace {
+		// Fall-through directories are mapped as is.
+		for _, dir := range gpf.cfg.FallThrough {
+			if rel == dir || strings.HasPrefix(rel, dir+pathSeparator) {
+				return []string{rel}
+			}
+		}
+	}
+
+	// Vendor directories are mapped to the top, but can also be looked up
+	// under the prefix directory.
+	paths := []string{}
+	for _, vendor := range gpf.cfg.Vendors {
+		if strings.HasPrefix(rel, vendor+pathSeparator) {
+			paths = append(paths, rel[len(vendor+pathSeparator):])
+			break
+		}
+	}
+	return append(paths, filepath.Join(gpf.cfg.GoPkgPrefix, rel))
+}
+
+// notifier tells the kernel about changes of the virtual tree, through the
+// FUSE API it's mounted with.
+type notifier interface {
+	// fileNotify invalidates the contents and attributes of the path.
+	fileNotify(path string)
+	// entryNotify invalidates the (negative) entry of the name in dir.
+	entryNotify(dir, name string)
+	// deleteNotify removes the entry of the name in dir.
+	deleteNotify(dir, name string)
+	// walk calls fn for the entries known to the kernel, children first.
+	walk(fn func(dir, name string))
+}
+
+// invalidate tells the kernel about the event of the path, relative to its
+// real tree, for every virtual path showing it.
+func (gpf *GoPathFs) invalidate(event notify.Event, from origin, rel string) {
+	gpf.invalidateChanges([]fileChange{{event: event, from: from, rel: rel}})
+}
+
+// invalidateChanges tells the kernel about the changes, for every virtual
+// path showing them. Changed files get their contents invalidated, created
+// ones their (negative) entries, and deleted ones are removed unless another
+// tree still provides them. Each changed directory is scanned once.
+func (gpf *GoPathFs) invalidateChanges(changes []fileChange) {
+	written := []string{}
+	moved := []string{}
+	for _, c := range changes {
+		for _, virtual := range gpf.virtualPaths(c.from, c.rel) {
+			if c.event == notify.Write {
+				written = append(written, virtual)
+			} else {
+				moved = append(moved, virtual)
+			}
+		}
+	}
+
+	// The index is updated before the kernel looks the paths up again.
+	gpf.index.changed(moved...)
+
+	n := gpf.notifier
+	if n == nil {
+		return
+	}
+	for _, virtual := range written {
+		n.fileNotify(virtual)
+	}
+
+	dirs := map[string]struct{}{}
+	for _, virtual := range moved {
+		dir, name := gpf.index.split(virtual)
+		if _, status := gpf.resolve(virtual).attr(); status == fuse.OK {
+			// Created, or still provided by another tree.
+			n.entryNotify(dir, name)
+			n.fileNotify(virtual)
+		} else {
+			gpf.inodes.remove(virtual)
+			n.deleteNotify(dir, name)
+		}
+		dirs[dir] = struct{}{}
+	}
+	// The directory listings changed.
+	for dir := range dirs {
+		n.fileNotify(dir)
+	}
+}
+
+// refreshDir reads the virtual directory again, e.g., after files were
+// generated in it.
+func (gpf *GoPathFs) refreshDir(name string) {
+	gpf.index.refresh(name)
+	if gpf.notifier != nil {
+		gpf.notifier.fileNotify(name)
+	}
+}
+
+// invalidateAll makes the kernel forget every entry and attribute it knows
+// and rebuilds the index, e.g., after the file watcher dropped events. The
+// kernel's negative entries expire after the negative timeout.
+func (gpf *GoPathFs) invalidateAll() {
+	gpf.index.reset()
+
+	n := gpf.notifier
+	if n == nil {
+		return
+	}
+	n.walk(func(dir, name string) {
+		n.fileNotify(filepath.Join(dir, name))
+		n.entryNotify(dir, name)
+	})
+	n.fileNotify("")
+}
@@ -0,0 +1,42 @@
+package gopathfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/linuxerwang/gobazel/conf"
+)
+
+func TestVirtualPaths(t *testing.T) {
+	gpf := &GoPathFs{
+		cfg: &conf.GobazelConf{
+			GoPkgPrefix: "p.com",
+			Vendors:     []string{"third_party"},
+			FallThrough: []string{"ft"},
+		},
+	}
+
+	for _, tc := range []struct {
+		from origin
+		rel  string
+		want []string
+	}{
+		{fromWorkspace, "a/a.go", []string{"p.com/a/a.go"}},
+		{fromWorkspace, "a", []string{"p.com/a"}},
+		{fromGenfiles, "a/a.pb.go", []string{"p.com/a/a.pb.go"}},
+		{fromWorkspace, "third_party/github.com/x/x.go", []string{"github.com/x/x.go", "p.com/third_party/github.com/x/x.go"}},
+		{fromGenfiles, "third_party/github.com/x/x.pb.go", []string{"github.com/x/x.pb.go", "p.com/third_party/github.com/x/x.pb.go"}},
+		{fromWorkspace, "third_party", []string{"p.com/third_party"}},
+		{fromWorkspace, "ft", []string{"ft"}},
+		{fromWorkspace, "ft/sub/f", []string{"ft/sub/f"}},
+		{fromWorkspace, "ftx/f", []string{"p.com/ftx/f"}},
+		// Only the workspace falls through.
+		{fromGenfiles, "ft/f.go", []string{"p.com/ft/f.go"}},
+		{fromGoSDK, "src/fmt/print.go", []string{"p.com/GOROOT/src/fmt/print.go"}},
+	} {
+		got := gpf.virtualPaths(tc.from, tc.rel)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("virtualPaths(%v, %q) = %q, want %q", tc.from, tc.rel, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package gopathfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lazyGen builds the generator targets of a first party package when it's
+// opened and its generated files are missing. Each package is checked at
+// most once per cool-down, the build runs in the background.
+type lazyGen struct {
+	gpf *GoPathFs
+
+	mu       sync.Mutex
+	lastTry  map[string]time.Time
+	inflight map[string]chan struct{}
+}
+
+// ensure starts building the missing generated files of the workspace
+// relative package directory, and waits for the build for the short wait.
+// Requests while the build runs don't wait, its files are notified when
+// they show up.
+func (lg *lazyGen) ensure(dir string) {
+	lc := lg.gpf.cfg.LazyGen
+	if lc == nil {
+		return
+	}
+
+	lg.mu.Lock()
+	if _, ok := lg.inflight[dir]; ok || time.Since(lg.lastTry[dir]) < lc.CoolDownDuration {
+		lg.mu.Unlock()
+		return
+	}
+	// Lookups of the package don't check again for the cool-down.
+	lg.lastTry[dir] = time.Now()
+	lg.mu.Unlock()
+
+	if !lg.hasBuildFile(dir) || lg.hasGenerated(dir) {
+		return
+	}
+
+	done := make(chan struct{})
+	lg.mu.Lock()
+	lg.inflight[dir] = done
+	lg.mu.Unlock()
+	go lg.generate(dir, done)
+
+	select {
+	case <-done:
+	case <-time.After(lc.WaitDuration):
+	}
+}
+
+func (lg *lazyGen) generate(dir string, done chan struct{}) {
+	lc := lg.gpf.cfg.LazyGen
+	defer func() {
+		lg.mu.Lock()
+		delete(lg.inflight, dir)
+		lg.mu.Unlock()
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), lc.TimeoutDuration)
+	defer cancel()
+
+	pkg := filepath.ToSlash(dir)
+	expr := fmt.Sprintf(`kind("^(%s) rule$", //%s:*)`, strings.Join(lc.Rules, "|"), pkg)
+	// A broken package elsewhere doesn't stop the generators found.
+	targets, _ := lg.gpf.bazel.Query(ctx, expr)
+	if len(targets) == 0 {
+		return
+	}
+
+	fmt.Printf("Generating the missing files of package %s.\n", pkg)
+	if lg.gpf.bazel.WaitIdle(ctx) != nil {
+		return
+	}
+	if _, err := lg.gpf.bazel.Build(ctx, targets); err != nil {
+		return
+	}
+
+	// The listing may have been returned before the build finished.
+	lg.gpf.refreshDir(filepath.Join(lg.gpf.cfg.GoPkgPrefix, dir))
+}
+
+func (lg *lazyGen) hasBuildFile(dir string) bool {
+	for _, build := range []string{"BUILD", "BUILD.bazel"} {
+		if _, err := os.Stat(filepath.Join(lg.gpf.dirs.Workspace, dir, build)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGenerated reports whether the package has generated .go files, also in
+// subdirectories, e.g., where go_proto_library puts them.
+func (lg *lazyGen) hasGenerated(dir string) bool {
+	found := errors.New("found")
+	err := filepath.Walk(filepath.Join(lg.gpf.dirs.GenfilesDir, dir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, ".go") {
+			return found
+		}
+		return nil
+	})
+	return err == found
+}
+
+func newLazyGen(gpf *GoPathFs) *lazyGen {
+	return &lazyGen{
+		gpf:      gpf,
+		lastTry:  map[string]time.Time{},
+		inflight: map[string]chan struct{}{},
+	}
+}
@@ -0,0 +1,56 @@
+package gopathfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linuxerwang/gobazel/conf"
+)
+
+func TestLazyGenHasGenerated(t *testing.T) {
+	tt := newTestTree(t)
+	if err := os.Mkdir(filepath.Join(tt.ws, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tt.ws, "b", "BUILD"), "")
+	if err := os.MkdirAll(filepath.Join(tt.gen, "b", "b_go_proto", "p.com", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tt.gen, "b", "b_go_proto", "p.com", "b", "b.pb.go"), "pb")
+	if err := os.MkdirAll(filepath.Join(tt.gen, "c", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tt.gen, "c", "sub", "c.txt"), "txt")
+
+	lg := tt.gpf.lazyGen
+	for _, tc := range []struct {
+		dir  string
+		want bool
+	}{
+		{"a", true},
+		{"b", true},
+		{"c", false},
+		{"missing", false},
+	} {
+		if got := lg.hasGenerated(tc.dir); got != tc.want {
+			t.Errorf("hasGenerated(%q) = %v, want %v", tc.dir, got, tc.want)
+		}
+	}
+
+	// Packages without generated files are checked once per cool-down.
+	tt.gpf.cfg.LazyGen = &conf.LazyGenConf{WaitDuration: time.Second, CoolDownDuration: time.Hour}
+	start := time.Now()
+	lg.ensure("c")
+	lg.ensure("c")
+	if since := time.Since(start); since > time.Second/2 {
+		t.Errorf("ensure of a package without BUILD file took %v", since)
+	}
+	if _, ok := lg.lastTry["c"]; !ok {
+		t.Errorf("ensure didn't record the check of c")
+	}
+	if len(lg.inflight) != 0 {
+		t.Errorf("ensure started builds %v", lg.inflight)
+	}
+}
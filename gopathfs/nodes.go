@@ -0,0 +1,469 @@
+package gopathfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// virtualNode is a node of the virtual tree. Each type of directory maps its
+// children to the real trees in its own way.
+type virtualNode interface {
+	fs.InodeEmbedder
+
+	base() *node
+	// realDirs returns the real paths which may provide the node, in the
+	// order they are searched. For directories, they are also the real
+	// directories providing the children.
+	realDirs() []realDir
+	// child returns the (detached) node of the named child.
+	child(name string) virtualNode
+	// attr returns the attributes of the node.
+	attr() (*fuse.Attr, fuse.Status)
+	// list lists the directory, if it's not indexed.
+	list() ([]fuse.DirEntry, fuse.Status)
+}
+
+// node is the state shared by all node types. It caches the real path the
+// node was resolved to, until the kernel is told about a change of it.
+type node struct {
+	fs.Inode
+	gpf  *GoPathFs
+	self virtualNode
+
+	mu   sync.Mutex
+	path string // The virtual path.
+	rel  string // The path relative to the real trees.
+	real string // The resolved real path, if any.
+}
+
+var (
+	_ = (fs.NodeLookuper)((*node)(nil))
+	_ = (fs.NodeGetattrer)((*node)(nil))
+	_ = (fs.NodeSetattrer)((*node)(nil))
+	_ = (fs.NodeAccesser)((*node)(nil))
+	_ = (fs.NodeReaddirer)((*node)(nil))
+	_ = (fs.NodeOpener)((*node)(nil))
+	_ = (fs.NodeCreater)((*node)(nil))
+	_ = (fs.NodeMkdirer)((*node)(nil))
+	_ = (fs.NodeRmdirer)((*node)(nil))
+	_ = (fs.NodeUnlinker)((*node)(nil))
+	_ = (fs.NodeRenamer)((*node)(nil))
+	_ = (fs.NodeOnAdder)((*topNode)(nil))
+	_ = (fs.NodeOnForgetter)((*node)(nil))
+)
+
+func (n *node) base() *node {
+	return n
+}
+
+func (n *node) init(gpf *GoPathFs, self virtualNode, path, rel string) virtualNode {
+	n.gpf, n.self, n.path, n.rel = gpf, self, path, rel
+	return self
+}
+
+func (n *node) paths() (string, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.path, n.rel
+}
+
+// realPath returns the real path of the node, resolving it if it's not
+// cached.
+func (n *node) realPath() (string, fuse.Status) {
+	n.mu.Lock()
+	real := n.real
+	n.mu.Unlock()
+	if real != "" {
+		return real, fuse.OK
+	}
+
+	path, _ := n.paths()
+	if real, ok := n.gpf.index.route(path); ok {
+		if real == "" {
+			return "", fuse.ENOENT
+		}
+		n.setReal(real)
+		return real, fuse.OK
+	}
+
+	for _, rd := range n.self.realDirs() {
+		if fi, err := os.Stat(rd.path); err == nil && rd.serves(fi.Name(), fi.IsDir()) {
+			n.setReal(rd.path)
+			return rd.path, fuse.OK
+		}
+	}
+	return "", fuse.ENOENT
+}
+
+// sourcePath returns the real path of the node outside of the generated
+// files, which gobazel never changes.
+func (n *node) sourcePath() (string, fuse.Status) {
+	for _, rd := range n.self.realDirs() {
+		if rd.generated {
+			continue
+		}
+		if _, err := os.Lstat(rd.path); err == nil {
+			return rd.path, fuse.OK
+		}
+	}
+	return "", fuse.ENOENT
+}
+
+// targetDir returns the real directory new children are created in.
+func (n *node) targetDir() (string, fuse.Status) {
+	dirs := n.self.realDirs()
+	if len(dirs) == 0 {
+		return "", fuse.ENOENT
+	}
+	return dirs[0].path, fuse.OK
+}
+
+func (n *node) setReal(real string) {
+	n.mu.Lock()
+	n.real = real
+	n.mu.Unlock()
+}
+
+// forget drops the cached real path.
+func (n *node) forget() {
+	n.setReal("")
+}
+
+// OnForget releases the inode number after the kernel forgot the node.
+func (n *node) OnForget() {
+	n.gpf.inodes.forget(n.StableAttr().Ino, n)
+}
+
+// move updates the paths of the node and its children after it's renamed.
+func (n *node) move(path, rel string) {
+	n.mu.Lock()
+	n.path, n.rel, n.real = path, rel, ""
+	n.mu.Unlock()
+	n.gpf.inodes.move(n.StableAttr().Ino, inodeKey{path: path, dir: n.IsDir()})
+
+	for name, child := range n.Children() {
+		if c, ok := child.Operations().(virtualNode); ok {
+			c.base().move(filepath.Join(path, name), filepath.Join(rel, name))
+		}
+	}
+}
+
+// Lookup looks up the child in the virtual tree.
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	c := n.self.child(name)
+	attr, status := c.attr()
+	if status != fuse.OK {
+		return nil, syscall.Errno(status)
+	}
+	out.Attr = *attr
+	return n.childInode(ctx, name, c, attr), 0
+}
+
+// childInode returns the inode of the looked up child, reusing the known one
+// if its type didn't change. New inodes get the number of the virtual path.
+func (n *node) childInode(ctx context.Context, name string, c virtualNode, attr *fuse.Attr) *fs.Inode {
+	mode := attr.Mode & syscall.S_IFMT
+	if child := n.GetChild(name); child != nil && child.Mode() == mode {
+		if old, ok := child.Operations().(virtualNode); ok && sameType(old, c) {
+			old.base().setReal(c.base().real)
+			return child
+		}
+	}
+	path, _ := c.base().paths()
+	ino := n.gpf.inodes.ino(inodeKey{path: path, dir: mode == syscall.S_IFDIR})
+	child := n.NewInode(ctx, c, fs.StableAttr{Mode: mode, Ino: ino})
+	if owner, ok := child.Operations().(virtualNode); ok {
+		n.gpf.inodes.own(ino, owner.base())
+	}
+	return child
+}
+
+// Access allows everything.
+func (n *node) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return 0
+}
+
+// topNode is the top directory of the virtual tree. It shows the prefix
+// directory, the fall-through directories and the vendor directories.
+type topNode struct {
+	node
+}
+
+// OnAdd notifies the changes through the root of the mounted tree.
+func (n *topNode) OnAdd(ctx context.Context) {
+	n.gpf.notifier = &fsNotifier{root: &n.Inode}
+}
+
+func (n *topNode) realDirs() []realDir {
+	return vendorDirs(n.gpf, "")
+}
+
+func (n *topNode) child(name string) virtualNode {
+	if name == n.gpf.cfg.GoPkgPrefix {
+		c := new(prefixNode)
+		return c.init(n.gpf, c, name, "")
+	}
+	for _, dir := range n.gpf.cfg.FallThrough {
+		if dir == name {
+			c := new(fallThroughNode)
+			return c.init(n.gpf, c, name, name)
+		}
+	}
+	c := new(vendorNode)
+	return c.init(n.gpf, c, name, name)
+}
+
+func (n *topNode) attr() (*fuse.Attr, fuse.Status) {
+	return n.syntheticDirAttr()
+}
+
+func (n *topNode) list() ([]fuse.DirEntry, fuse.Status) {
+	return n.gpf.openTopDir()
+}
+
+// prefixNode is the directory of the Go package prefix, which shows the
+// workspace and its generated files.
+type prefixNode struct {
+	node
+}
+
+func (n *prefixNode) realDirs() []realDir {
+	return firstPartyDirs(n.gpf, "")
+}
+
+func (n *prefixNode) child(name string) virtualNode {
+	path := filepath.Join(n.gpf.cfg.GoPkgPrefix, name)
+	if name == "GOROOT" {
+		c := new(goRootNode)
+		return c.init(n.gpf, c, path, "")
+	}
+	c := new(firstPartyNode)
+	return c.init(n.gpf, c, path, name)
+}
+
+func (n *prefixNode) attr() (*fuse.Attr, fuse.Status) {
+	return n.syntheticDirAttr()
+}
+
+func (n *prefixNode) list() ([]fuse.DirEntry, fuse.Status) {
+	return n.gpf.openFirstPartyDir()
+}
+
+// firstPartyNode is a file or directory in the workspace or its generated
+// files.
+type firstPartyNode struct {
+	node
+}
+
+func (n *firstPartyNode) realDirs() []realDir {
+	_, rel := n.paths()
+	return firstPartyDirs(n.gpf, rel)
+}
+
+func (n *firstPartyNode) child(name string) virtualNode {
+	path, rel := n.paths()
+	c := new(firstPartyNode)
+	return c.init(n.gpf, c, filepath.Join(path, name), filepath.Join(rel, name))
+}
+
+// Lookup generates the missing generated files first, if enabled, and
+// watches them.
+func (n *firstPartyNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	_, rel := n.paths()
+	n.gpf.genWatcher.serve(rel)
+	n.gpf.lazyGen.ensure(rel)
+	return n.node.Lookup(ctx, name, out)
+}
+
+// Readdir generates the missing generated files first, if enabled, and
+// watches them.
+func (n *firstPartyNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	_, rel := n.paths()
+	n.gpf.genWatcher.serve(rel)
+	n.gpf.lazyGen.ensure(rel)
+	return n.node.Readdir(ctx)
+}
+
+// vendorNode is a file or directory in the vendor directories or their
+// generated files.
+type vendorNode struct {
+	node
+}
+
+func (n *vendorNode) realDirs() []realDir {
+	_, rel := n.paths()
+	return vendorDirs(n.gpf, rel)
+}
+
+func (n *vendorNode) child(name string) virtualNode {
+	path, rel := n.paths()
+	c := new(vendorNode)
+	return c.init(n.gpf, c, filepath.Join(path, name), filepath.Join(rel, name))
+}
+
+// Lookup watches the generated files of the directory.
+func (n *vendorNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.serve()
+	return n.node.Lookup(ctx, name, out)
+}
+
+// Readdir watches the generated files of the directory.
+func (n *vendorNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	n.serve()
+	return n.node.Readdir(ctx)
+}
+
+func (n *vendorNode) serve() {
+	_, rel := n.paths()
+	for _, vendor := range n.gpf.cfg.Vendors {
+		n.gpf.genWatcher.serve(filepath.Join(vendor, rel))
+	}
+}
+
+// fallThroughNode is a file or directory in a fall-through directory, which
+// is mapped as is.
+type fallThroughNode struct {
+	node
+}
+
+func (n *fallThroughNode) realDirs() []realDir {
+	_, rel := n.paths()
+	return []realDir{{path: filepath.Join(n.gpf.dirs.Workspace, rel)}}
+}
+
+func (n *fallThroughNode) child(name string) virtualNode {
+	path, rel := n.paths()
+	c := new(fallThroughNode)
+	return c.init(n.gpf, c, filepath.Join(path, name), filepath.Join(rel, name))
+}
+
+func (n *fallThroughNode) list() ([]fuse.DirEntry, fuse.Status) {
+	return n.listDirs(nil /* excludes */)
+}
+
+// goRootNode is a file or directory in the Go SDK (for debugger).
+type goRootNode struct {
+	node
+}
+
+func (n *goRootNode) realDirs() []realDir {
+	_, rel := n.paths()
+	return []realDir{{path: filepath.Join(n.gpf.dirs.GoSDKDir, rel)}}
+}
+
+func (n *goRootNode) child(name string) virtualNode {
+	path, rel := n.paths()
+	c := new(goRootNode)
+	return c.init(n.gpf, c, filepath.Join(path, name), filepath.Join(rel, name))
+}
+
+func (n *goRootNode) list() ([]fuse.DirEntry, fuse.Status) {
+	return n.listDirs(nil /* excludes */)
+}
+
+func firstPartyDirs(gpf *GoPathFs, rel string) []realDir {
+	dirs := []realDir{{path: filepath.Join(gpf.dirs.Workspace, rel)}}
+	return append(dirs, gpf.genDirs(rel)...)
+}
+
+func vendorDirs(gpf *GoPathFs, rel string) []realDir {
+	dirs := []realDir{}
+	for _, vendor := range gpf.cfg.Vendors {
+		dirs = append(dirs, realDir{path: filepath.Join(gpf.dirs.Workspace, vendor, rel)})
+		dirs = append(dirs, gpf.genDirs(filepath.Join(vendor, rel))...)
+	}
+	return dirs
+}
+
+func sameType(a, b virtualNode) bool {
+	return reflect.TypeOf(a) == reflect.TypeOf(b)
+}
+
+// resolve returns the detached node of the virtual path, e.g., to look up
+// the paths of a file change.
+func (gpf *GoPathFs) resolve(name string) virtualNode {
+	var n virtualNode = gpf.newTopNode()
+	if name == "" {
+		return n
+	}
+	for _, base := range strings.Split(name, pathSeparator) {
+		n = n.child(base)
+	}
+	return n
+}
+
+func (gpf *GoPathFs) newTopNode() *topNode {
+	n := new(topNode)
+	n.init(gpf, n, "", "")
+	return n
+}
+
+// fsNotifier is the notifier of the fs API. The nodes told about forget
+// their cached real paths.
+type fsNotifier struct {
+	root *fs.Inode
+}
+
+func (fn *fsNotifier) node(path string) *fs.Inode {
+	node := fn.root
+	if path == "" {
+		return node
+	}
+	for _, name := range strings.Split(path, pathSeparator) {
+		if node = node.GetChild(name); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+func (fn *fsNotifier) fileNotify(path string) {
+	if node := fn.node(path); node != nil {
+		if n, ok := node.Operations().(virtualNode); ok {
+			n.base().forget()
+		}
+		node.NotifyContent(0, 0)
+	}
+}
+
+func (fn *fsNotifier) entryNotify(dir, name string) {
+	if node := fn.node(dir); node != nil {
+		node.NotifyEntry(name)
+	}
+}
+
+func (fn *fsNotifier) deleteNotify(dir, name string) {
+	parent := fn.node(dir)
+	if parent == nil {
+		return
+	}
+	if child := parent.GetChild(name); child != nil {
+		parent.NotifyDelete(name, child)
+		return
+	}
+	parent.NotifyEntry(name)
+}
+
+func (fn *fsNotifier) walk(f func(dir, name string)) {
+	var walk func(dir string, node *fs.Inode)
+	walk = func(dir string, node *fs.Inode) {
+		for name, child := range node.Children() {
+			walk(filepath.Join(dir, name), child)
+			f(dir, name)
+		}
+	}
+	walk("", fn.root)
+}
+
+// NewRoot returns the root node of the virtual tree.
+func NewRoot(gpf *GoPathFs) fs.InodeEmbedder {
+	return gpf.newTopNode()
+}
@@ -0,0 +1,257 @@
+package gopathfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxerwang/gobazel/exec"
+	"github.com/rjeczalik/notify"
+)
+
+const (
+	snapshotDirName = "gen"
+	snapshotPoll    = 2 * time.Second
+)
+
+// genFile identifies a version of a generated file.
+type genFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// genSnapshot serves the generated .go files of the last finished build
+// while bazel rewrites the output tree. A snapshot is a tree of hard links
+// in GOPATH/.gobazel/gen/<generation>, which keep the old contents when bazel
+// replaces the files. The other generated files are served from the output
+// tree.
+type genSnapshot struct {
+	gpf  *GoPathFs
+	root string
+
+	refreshMu sync.Mutex
+	mu        sync.RWMutex
+	gen       int
+	dir       string
+	files     map[string]genFile
+	// pending is set while a refresh waits for the user's bazel server.
+	pending bool
+	// unknown is set once the user's bazel server wasn't found.
+	unknown bool
+}
+
+// Dir returns the directory of the current snapshot.
+func (gs *genSnapshot) Dir() string {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.dir
+}
+
+// refresh takes a new snapshot of the generated files, switches to it and
+// invalidates the virtual paths of the changed files.
+func (gs *genSnapshot) refresh() {
+	gs.refreshMu.Lock()
+	defer gs.refreshMu.Unlock()
+
+	gs.mu.RLock()
+	gen, old := gs.gen+1, gs.files
+	gs.mu.RUnlock()
+
+	dir := filepath.Join(gs.root, strconv.Itoa(gen))
+	os.RemoveAll(dir)
+	files, err := gs.link(dir)
+	if err != nil {
+		fmt.Printf("Failed to snapshot the generated files, %v.\n", err)
+		os.RemoveAll(dir)
+		return
+	}
+
+	changed := map[string]notify.Event{}
+	for rel, f := range files {
+		if o, ok := old[rel]; !ok {
+			changed[rel] = notify.Create
+		} else if o != f {
+			changed[rel] = notify.Write
+		}
+	}
+	for rel := range old {
+		if _, ok := files[rel]; !ok {
+			changed[rel] = notify.Remove
+		}
+	}
+	if old != nil && len(changed) == 0 {
+		os.RemoveAll(dir)
+		return
+	}
+
+	gs.mu.Lock()
+	prev := gs.gen
+	gs.gen, gs.dir, gs.files = gen, dir, files
+	gs.mu.Unlock()
+
+	// Files just opened in the previous snapshot can still be resolved.
+	os.RemoveAll(filepath.Join(gs.root, strconv.Itoa(prev-1)))
+
+	changes := make([]fileChange, 0, len(changed))
+	for rel, event := range changed {
+		changes = append(changes, fileChange{event: event, from: fromGenfiles, rel: rel})
+	}
+	gs.gpf.invalidateChanges(changes)
+}
+
+// link mirrors the generated .go files of the packages in the virtual tree
+// into dir with hard links, or copies them if the output tree is on another
+// file system.
+func (gs *genSnapshot) link(dir string) (map[string]genFile, error) {
+	src := gs.gpf.dirs.GenfilesDir
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return map[string]genFile{}, os.MkdirAll(dir, 0755)
+	}
+
+	// The output tree also has the external repositories and runfiles,
+	// which aren't served.
+	tops := append([]string{}, gs.gpf.cfg.Vendors...)
+	entries, _ := gs.gpf.openFirstPartyDir()
+	for _, e := range entries {
+		tops = append(tops, e.Name)
+	}
+
+	files := map[string]genFile{}
+	copied := 0
+	for _, top := range tops {
+		err := filepath.Walk(filepath.Join(src, top), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && strings.HasSuffix(info.Name(), ".runfiles") {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), ".go") {
+				return nil
+			}
+
+			rel := path[len(src+pathSeparator):]
+			target := filepath.Join(dir, rel)
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(path, target); err != nil {
+				if err := copyFile(path, target, info.Mode()); err != nil {
+					return err
+				}
+				copied++
+			}
+			files[rel] = genFile{size: info.Size(), modTime: info.ModTime()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if copied > 0 {
+		fmt.Printf("Copied %d generated files into the snapshot, they can't be hard linked from %s.\n", copied, src)
+	}
+	return files, os.MkdirAll(dir, 0755)
+}
+
+// watch refreshes the snapshot whenever gobazel's builds finish. With a
+// dedicated output base, only they change the generated files.
+func (gs *genSnapshot) watch() {
+	gs.gpf.bazel.OnBuildsDone(func() {
+		go gs.refresh()
+	})
+	if cfg := gs.gpf.cfg; cfg.Bazel != nil && cfg.Bazel.OutputBase != "" {
+		gs.refresh()
+		return
+	}
+	gs.changed()
+}
+
+// changed refreshes the snapshot after the output tree changed, once the
+// user's bazel server is idle. The server is only polled while it's busy.
+func (gs *genSnapshot) changed() {
+	if cfg := gs.gpf.cfg; cfg.Bazel != nil && cfg.Bazel.OutputBase != "" {
+		return
+	}
+	if _, ok := exec.UserOutputBase(gs.gpf.dirs.Workspace); !ok {
+		// Without its lock file, a running build can't be told from a
+		// finished one. Only gobazel's builds refresh the snapshot then.
+		gs.mu.Lock()
+		unknown := gs.unknown
+		gs.unknown = true
+		gs.mu.Unlock()
+		if !unknown {
+			fmt.Println("Could not find the output base of the bazel server, the generated files are only updated after gobazel's builds.")
+		}
+		return
+	}
+
+	gs.mu.Lock()
+	pending := gs.pending
+	gs.pending = true
+	gs.mu.Unlock()
+	if pending {
+		return
+	}
+
+	go func() {
+		// The first changes may come before bazel holds its lock.
+		time.Sleep(snapshotPoll)
+		for gs.gpf.bazel.Busy() {
+			time.Sleep(snapshotPoll)
+		}
+
+		gs.mu.Lock()
+		gs.pending = false
+		gs.mu.Unlock()
+		gs.refresh()
+	}()
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// newGenSnapshot returns a genSnapshot continuing from the latest snapshot
+// of a previous run, if any.
+func newGenSnapshot(gpf *GoPathFs) *genSnapshot {
+	gs := genSnapshot{
+		gpf:  gpf,
+		root: filepath.Join(gpf.dirs.StateDir, snapshotDirName),
+		dir:  gpf.dirs.GenfilesDir,
+	}
+
+	fis, _ := ioutil.ReadDir(gs.root)
+	for _, fi := range fis {
+		if n, err := strconv.Atoi(fi.Name()); err == nil && n > gs.gen {
+			gs.gen = n
+			gs.dir = filepath.Join(gs.root, fi.Name())
+		}
+	}
+	for _, fi := range fis {
+		if dir := filepath.Join(gs.root, fi.Name()); dir != gs.dir {
+			os.RemoveAll(dir)
+		}
+	}
+	return &gs
+}
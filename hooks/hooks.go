@@ -0,0 +1,604 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/exec"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+// LogFile is the name of the file in the gobazel state directory the hook
+// results are written to.
+const LogFile = "hooks.log"
+
+var (
+	varRe = regexp.MustCompile(`\{[a-z]+\}`)
+)
+
+type hook struct {
+	cfg      *conf.HookConf
+	patterns []*regexp.Regexp
+	events   map[string]struct{}
+	argv     []string
+	rdeps    bool
+	sem      chan struct{}
+
+	mu   sync.Mutex
+	jobs []*job
+}
+
+// job is a run of a hook for the matching events of a batch. It's canceled
+// when a newer batch changes the same targets.
+type job struct {
+	hook     *hook
+	ctx      context.Context
+	cancel   context.CancelFunc
+	varsList []map[string]string
+	targets  map[string]struct{}
+}
+
+// Event is a change of a workspace relative path.
+type Event struct {
+	Kind string
+	Path string
+}
+
+// Runner runs the configured hooks on file changes. Events are collected
+// until no new event arrived for the quiet window, and then handled as one
+// batch.
+type Runner struct {
+	cfg       *conf.GobazelConf
+	workspace string
+	mapper    *pathmap.Mapper
+	bazel     *exec.Bazel
+	hooks     []*hook
+	listing   *listing
+	ctx       context.Context
+	stop      context.CancelFunc
+
+	logMu sync.Mutex
+	log   io.Writer
+
+	mu       sync.Mutex
+	pending  map[string]string
+	order    []string
+	overflow bool
+	timer    *time.Timer
+}
+
+// Add queues the event kind (create, write, remove or rename) of the
+// workspace relative path.
+func (r *Runner) Add(kind, path string) {
+	if len(r.hooks) == 0 {
+		return
+	}
+	r.listing.update(path)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.overflow {
+		if _, ok := r.pending[path]; !ok {
+			if len(r.order) >= r.cfg.Hooks.MaxPending {
+				// Too many events, rescan instead.
+				r.setOverflow()
+			} else {
+				r.order = append(r.order, path)
+			}
+		}
+		if !r.overflow {
+			r.pending[path] = kind
+		}
+	}
+	r.resetTimer()
+}
+
+// Overflow signals that events might have been dropped. The next batch
+// rescans the directories of the files the hooks match for changes.
+func (r *Runner) Overflow() {
+	if len(r.hooks) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.setOverflow()
+	r.resetTimer()
+}
+
+// must hold r.mu
+func (r *Runner) setOverflow() {
+	if !r.overflow {
+		r.logf("Too many file events, the changed files will be rescanned.\n")
+	}
+	r.overflow = true
+	r.pending = map[string]string{}
+	r.order = nil
+}
+
+// must hold r.mu
+func (r *Runner) resetTimer() {
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.cfg.Hooks.QuietWindowDuration, r.flush)
+		return
+	}
+	r.timer.Reset(r.cfg.Hooks.QuietWindowDuration)
+}
+
+func (r *Runner) flush() {
+	if r.ctx.Err() != nil {
+		return
+	}
+
+	r.mu.Lock()
+	events := make([]Event, 0, len(r.order))
+	for _, path := range r.order {
+		events = append(events, Event{Kind: r.pending[path], Path: path})
+	}
+	overflow := r.overflow
+	r.pending = map[string]string{}
+	r.order = nil
+	r.overflow = false
+	r.mu.Unlock()
+
+	if overflow {
+		events = append(events, r.listing.rescan()...)
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	r.runBatch(events)
+}
+
+// runBatch runs the hooks matching the events, one after another in the
+// configured order. A hook in batch mode runs once with the values of all
+// events, otherwise it runs once per distinct command. In-flight runs of the
+// same targets are canceled, and their values are taken over.
+func (r *Runner) runBatch(events []Event) {
+	varsCache := map[string]map[string]string{}
+	jobs := []*job{}
+	for _, h := range r.hooks {
+		varsList := []map[string]string{}
+		for _, e := range events {
+			if !h.matches(e.Kind, e.Path) {
+				continue
+			}
+			vars, ok := varsCache[e.Path]
+			if !ok {
+				vars = r.vars(e.Path)
+				varsCache[e.Path] = vars
+			}
+			varsList = append(varsList, vars)
+		}
+		if len(varsList) > 0 {
+			jobs = append(jobs, h.newJob(r.ctx, varsList))
+		}
+	}
+
+	for _, j := range jobs {
+		r.runJob(j)
+	}
+}
+
+func (r *Runner) runJob(j *job) {
+	h := j.hook
+	defer h.done(j)
+
+	varsList := j.varsList
+	if h.rdeps {
+		if varsList = r.withRdeps(j.ctx, h, varsList); len(varsList) == 0 {
+			return
+		}
+	}
+
+	if h.cfg.Batch {
+		r.run(j, mergeArgv(h.argv, varsList))
+		return
+	}
+
+	seen := map[string]struct{}{}
+	for _, vars := range varsList {
+		if j.ctx.Err() != nil {
+			return
+		}
+
+		argv := []string{}
+		for _, arg := range h.argv {
+			argv = append(argv, expandArg(arg, vars)...)
+		}
+		// De-duplicate, e.g., the events of the same package.
+		key := strings.Join(argv, "\x00")
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		r.run(j, argv)
+	}
+}
+
+func (r *Runner) run(j *job, argv []string) {
+	h := j.hook
+	select {
+	case h.sem <- struct{}{}:
+	case <-j.ctx.Done():
+		return
+	}
+	defer func() { <-h.sem }()
+
+	ctx, cancel := context.WithTimeout(j.ctx, h.cfg.TimeoutDuration)
+	defer cancel()
+
+	cmd := strings.Join(argv, " ")
+	var out []byte
+	var err error
+	if argv[0] == "bazel" {
+		if r.bazel.WaitIdle(j.ctx) != nil {
+			return
+		}
+		out, err = r.bazel.Run(ctx, r.cfg, argv[1:])
+	} else {
+		out, err = exec.RunCommandContext(ctx, r.cfg, r.workspace, argv)
+	}
+	if j.ctx.Err() != nil {
+		// Superseded, the newer run reports the result.
+		return
+	}
+	var result string
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result = fmt.Sprintf("timed out after %v!", h.cfg.TimeoutDuration)
+	case err != nil:
+		result = fmt.Sprintf("failed: %v!", err)
+	default:
+		result = "done"
+	}
+	r.logf("[hook %s] %s (%s)\n%s", h.cfg.Name, cmd, result, out)
+}
+
+// logf reports on stdout and in the hooks log, where the results of a
+// detached gobazel can be found.
+func (r *Runner) logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Print(msg)
+
+	if r.log == nil {
+		return
+	}
+	r.logMu.Lock()
+	defer r.logMu.Unlock()
+	fmt.Fprintf(r.log, "%s %s", time.Now().Format("2006-01-02 15:04:05"), msg)
+}
+
+// vars returns the template variables for the workspace relative path.
+func (r *Runner) vars(path string) map[string]string {
+	dir := filepath.Dir(path)
+	pkg := r.mapper.BazelPackage(dir)
+
+	name := path
+	if pkg != "" {
+		name = path[len(pkg)+1:]
+	}
+
+	return map[string]string{
+		"{file}":       path,
+		"{dir}":        dir,
+		"{importpath}": r.mapper.ImportPath(dir),
+		"{package}":    "//" + pkg,
+		"{label}":      "//" + pkg + ":" + name,
+		"{workspace}":  r.workspace,
+	}
+}
+
+// withRdeps returns copies of the vars with {rdeps}, the targets of the
+// hook's rdeps-kinds depending on any of the files. One query is run for
+// the whole batch, its results are cached by the query cache. Nil is
+// returned if no targets are affected or ctx is canceled.
+func (r *Runner) withRdeps(ctx context.Context, h *hook, varsList []map[string]string) []map[string]string {
+	seen := map[string]struct{}{}
+	labels := []string{}
+	for _, vars := range varsList {
+		if _, ok := seen[vars["{label}"]]; !ok {
+			seen[vars["{label}"]] = struct{}{}
+			labels = append(labels, vars["{label}"])
+		}
+	}
+	// The same files give the same query.
+	sort.Strings(labels)
+
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.TimeoutDuration)
+	defer cancel()
+
+	if r.bazel.WaitIdle(ctx) != nil {
+		return nil
+	}
+	expr := fmt.Sprintf(`kind("^(%s) rule$", rdeps(//..., set(%s)))`, strings.Join(h.cfg.RdepsKinds, "|"), strings.Join(labels, " "))
+	targets, err := r.bazel.Query(ctx, expr)
+	if ctx.Err() == context.Canceled {
+		// Superseded or stopped.
+		return nil
+	}
+	if err != nil {
+		r.logf("[hook %s] bazel query %s (failed: %v!)\n", h.cfg.Name, expr, err)
+	}
+	if len(targets) == 0 {
+		// No affected targets.
+		return nil
+	}
+
+	return addRdeps(varsList, targets)
+}
+
+// addRdeps returns copies of the vars with {rdeps} set to the targets.
+func addRdeps(varsList []map[string]string, targets []string) []map[string]string {
+	rdeps := strings.Join(targets, " ")
+	withRdeps := make([]map[string]string, 0, len(varsList))
+	for _, vars := range varsList {
+		v := make(map[string]string, len(vars)+1)
+		for k, val := range vars {
+			v[k] = val
+		}
+		v["{rdeps}"] = rdeps
+		withRdeps = append(withRdeps, v)
+	}
+	return withRdeps
+}
+
+func (h *hook) matches(event, path string) bool {
+	if _, ok := h.events[event]; !ok {
+		return false
+	}
+	return h.matchesPath(path)
+}
+
+func (h *hook) matchesPath(path string) bool {
+	if len(h.patterns) == 0 {
+		return true
+	}
+	path = filepath.ToSlash(path)
+	for _, re := range h.patterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// newJob returns a new job of the hook for the given values, canceled with
+// ctx. The hook's in-flight jobs sharing targets with it are canceled, the
+// new job takes over their values.
+func (h *hook) newJob(ctx context.Context, varsList []map[string]string) *job {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	targets := h.targets(varsList)
+	jobs := []*job{}
+	for _, old := range h.jobs {
+		if !old.intersects(targets) {
+			jobs = append(jobs, old)
+			continue
+		}
+
+		old.cancel()
+		varsList = append(append([]map[string]string{}, old.varsList...), varsList...)
+		for t := range old.targets {
+			targets[t] = struct{}{}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	j := job{
+		hook:     h,
+		ctx:      ctx,
+		cancel:   cancel,
+		varsList: varsList,
+		targets:  targets,
+	}
+	h.jobs = append(jobs, &j)
+	return &j
+}
+
+func (h *hook) done(j *job) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	j.cancel()
+	for i, jj := range h.jobs {
+		if jj == j {
+			h.jobs = append(h.jobs[:i], h.jobs[i+1:]...)
+			break
+		}
+	}
+}
+
+// targets returns the expanded template arguments of the values. The
+// {rdeps} aren't known before the job runs, the changed files stand in for
+// them. A command without variables has a single (empty) target.
+func (h *hook) targets(varsList []map[string]string) map[string]struct{} {
+	targets := map[string]struct{}{}
+	if h.rdeps {
+		for _, vars := range varsList {
+			targets[vars["{label}"]] = struct{}{}
+		}
+	}
+	for _, arg := range h.argv {
+		if !varRe.MatchString(arg) || strings.Contains(arg, "{rdeps}") {
+			continue
+		}
+		for _, vars := range varsList {
+			for _, t := range expandArg(arg, vars) {
+				targets[t] = struct{}{}
+			}
+		}
+	}
+	if len(targets) == 0 {
+		targets[""] = struct{}{}
+	}
+	return targets
+}
+
+func (j *job) intersects(targets map[string]struct{}) bool {
+	for t := range targets {
+		if _, ok := j.targets[t]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeArgv expands the command template with the values of all events.
+// Arguments without variables appear once, arguments with variables appear
+// once per distinct value.
+func mergeArgv(tmpl []string, varsList []map[string]string) []string {
+	argv := []string{}
+	for _, arg := range tmpl {
+		if !varRe.MatchString(arg) {
+			argv = append(argv, arg)
+			continue
+		}
+
+		seen := map[string]struct{}{}
+		for _, vars := range varsList {
+			for _, v := range expandArg(arg, vars) {
+				if _, ok := seen[v]; !ok {
+					seen[v] = struct{}{}
+					argv = append(argv, v)
+				}
+			}
+		}
+	}
+	return argv
+}
+
+// expandArg expands the template argument. As a whole argument, {rdeps}
+// expands to one argument per target.
+func expandArg(arg string, vars map[string]string) []string {
+	if arg == "{rdeps}" {
+		return strings.Fields(vars[arg])
+	}
+	return []string{expand(arg, vars)}
+}
+
+func expand(arg string, vars map[string]string) string {
+	return varRe.ReplaceAllStringFunc(arg, func(v string) string {
+		if val, ok := vars[v]; ok {
+			return val
+		}
+		return v
+	})
+}
+
+// globToRegexp converts a path glob to a regular expression. "**" matches
+// any number of directories, "*" and "?" don't match "/".
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// Scan lists the files the hooks match, to find their changes when events
+// were dropped.
+func (r *Runner) Scan() {
+	if len(r.hooks) > 0 {
+		r.listing.scan()
+	}
+}
+
+// matches reports whether any hook matches the path.
+func (r *Runner) matches(path string) bool {
+	for _, h := range r.hooks {
+		if h.matchesPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop cancels the running hooks and the hooks of later batches.
+func (r *Runner) Stop() {
+	r.stop()
+}
+
+// NewRunner returns a new Runner for the enabled hooks in the config. Bazel
+// commands run with the options of bzl. The paths skip reports aren't
+// listed to find changes when events were lost. The results are also logged
+// to LogFile in stateDir.
+func NewRunner(cfg *conf.GobazelConf, workspace, srcDir, stateDir string, bzl *exec.Bazel, skip SkipFunc) *Runner {
+	ctx, stop := context.WithCancel(context.Background())
+	r := Runner{
+		ctx:       ctx,
+		stop:      stop,
+		cfg:       cfg,
+		workspace: workspace,
+		mapper:    pathmap.New(cfg, workspace, srcDir),
+		bazel:     bzl,
+		pending:   map[string]string{},
+	}
+	r.listing = newListing(workspace, skip, r.matches)
+
+	if cfg.Hooks == nil {
+		return &r
+	}
+
+	logFile := filepath.Join(stateDir, LogFile)
+	if f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		fmt.Printf("Failed to open the hooks log %s, %v.\n", logFile, err)
+	} else {
+		r.log = f
+	}
+	for _, hc := range cfg.Hooks.Hooks {
+		if hc.Disabled {
+			continue
+		}
+
+		h := hook{
+			cfg:    hc,
+			events: map[string]struct{}{},
+			argv:   strings.Fields(hc.Command),
+			rdeps:  strings.Contains(hc.Command, "{rdeps}"),
+			sem:    make(chan struct{}, hc.Concurrency),
+		}
+		for _, e := range hc.Events {
+			h.events[e] = struct{}{}
+		}
+		for _, p := range hc.Paths {
+			re, err := globToRegexp(p)
+			if err != nil {
+				fmt.Printf("Invalid path glob %s of hook %s, %v.\n", p, hc.Name, err)
+				continue
+			}
+			h.patterns = append(h.patterns, re)
+		}
+		r.hooks = append(r.hooks, &h)
+	}
+	return &r
+}
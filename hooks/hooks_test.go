@@ -0,0 +1,279 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxerwang/gobazel/conf"
+)
+
+func TestMatches(t *testing.T) {
+	for _, tc := range []struct {
+		paths  []string
+		events []string
+		event  string
+		path   string
+		want   bool
+	}{
+		{[]string{"**/*.proto"}, nil, "write", "a.proto", true},
+		{[]string{"**/*.proto"}, nil, "write", "a/b/c.proto", true},
+		{[]string{"**/*.proto"}, nil, "write", "a/b/c.proto.bak", false},
+		{[]string{"a/*.go"}, nil, "write", "a/a.go", true},
+		{[]string{"a/*.go"}, nil, "write", "a/b/a.go", false},
+		{[]string{"a/**"}, nil, "write", "a/b/a.go", true},
+		{[]string{"a/?.go"}, nil, "write", "a/ab.go", false},
+		{[]string{"a/b.go", "c/**/d.go"}, nil, "create", "c/x/y/d.go", true},
+		{[]string{"a+b/*.go"}, nil, "write", "a+b/c.go", true},
+		{[]string{"a+b/*.go"}, nil, "write", "aab/c.go", false},
+		{nil, nil, "remove", "any/file", true},
+		{nil, []string{"create", "write"}, "remove", "a.go", false},
+		{[]string{"**/*.go"}, []string{"rename"}, "rename", "a/a.go", true},
+	} {
+		events := tc.events
+		if events == nil {
+			events = conf.HookEvents
+		}
+		h := hook{events: map[string]struct{}{}}
+		for _, e := range events {
+			h.events[e] = struct{}{}
+		}
+		for _, p := range tc.paths {
+			re, err := globToRegexp(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.patterns = append(h.patterns, re)
+		}
+		if got := h.matches(tc.event, tc.path); got != tc.want {
+			t.Errorf("hook %v %v matches(%s, %s) = %v, want %v", tc.paths, tc.events, tc.event, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestExpansion(t *testing.T) {
+	a := map[string]string{"{file}": "a/a.proto", "{label}": "//a:a.proto", "{importpath}": "p.com/a"}
+	b := map[string]string{"{file}": "a/b.proto", "{label}": "//a:b.proto", "{importpath}": "p.com/a"}
+	varsList := addRdeps([]map[string]string{a, b}, []string{"//a:a_go_proto", "//c:c_go_proto"})
+	if _, ok := a["{rdeps}"]; ok {
+		t.Errorf("addRdeps changed the vars")
+	}
+
+	for _, tc := range []struct {
+		tmpl  string
+		batch string
+		each  []string
+	}{
+		{"bazel build {rdeps}", "bazel build //a:a_go_proto //c:c_go_proto", []string{"bazel build //a:a_go_proto //c:c_go_proto"}},
+		{"echo rdeps={rdeps}", "echo rdeps=//a:a_go_proto //c:c_go_proto", []string{"echo rdeps=//a:a_go_proto //c:c_go_proto"}},
+		{"go install {importpath}", "go install p.com/a", []string{"go install p.com/a"}},
+		{"lint {file} {importpath}", "lint a/a.proto a/b.proto p.com/a", []string{"lint a/a.proto p.com/a", "lint a/b.proto p.com/a"}},
+		{"echo {unknown}", "echo {unknown}", []string{"echo {unknown}"}},
+	} {
+		argv := strings.Fields(tc.tmpl)
+		if got := strings.Join(mergeArgv(argv, varsList), " "); got != tc.batch {
+			t.Errorf("mergeArgv(%q) = %q, want %q", tc.tmpl, got, tc.batch)
+		}
+		each := []string{}
+		seen := map[string]struct{}{}
+		for _, vars := range varsList {
+			expanded := []string{}
+			for _, arg := range argv {
+				expanded = append(expanded, expandArg(arg, vars)...)
+			}
+			if cmd := strings.Join(expanded, " "); !contains(seen, cmd) {
+				each = append(each, cmd)
+			}
+		}
+		if fmt.Sprint(each) != fmt.Sprint(tc.each) {
+			t.Errorf("expandArg(%q) = %q, want %q", tc.tmpl, each, tc.each)
+		}
+	}
+}
+
+func contains(seen map[string]struct{}, s string) bool {
+	_, ok := seen[s]
+	seen[s] = struct{}{}
+	return ok
+}
+
+func TestTargets(t *testing.T) {
+	a := map[string]string{"{file}": "a/a.go", "{label}": "//a:a.go", "{importpath}": "p.com/a"}
+	b := map[string]string{"{file}": "b/b.go", "{label}": "//b:b.go", "{importpath}": "p.com/b"}
+
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{"go install {importpath}", "map[p.com/a:{} p.com/b:{}]"},
+		{"bazel build {rdeps}", "map[//a:a.go:{} //b:b.go:{}]"},
+		{"make all", "map[:{}]"},
+	} {
+		h := hook{argv: strings.Fields(tc.cmd), rdeps: strings.Contains(tc.cmd, "{rdeps}")}
+		if got := fmt.Sprint(h.targets([]map[string]string{a, b})); got != tc.want {
+			t.Errorf("targets of %q = %s, want %s", tc.cmd, got, tc.want)
+		}
+	}
+
+	// Jobs sharing targets supersede the running ones and take over their
+	// values.
+	h := hook{argv: []string{"go", "install", "{importpath}"}}
+	old := h.newJob(context.Background(), []map[string]string{a})
+	other := h.newJob(context.Background(), []map[string]string{b})
+	j := h.newJob(context.Background(), []map[string]string{a})
+	if old.ctx.Err() == nil {
+		t.Errorf("superseded job isn't canceled")
+	}
+	if other.ctx.Err() != nil {
+		t.Errorf("job of other targets is canceled")
+	}
+	if len(j.varsList) != 2 || len(h.jobs) != 2 {
+		t.Errorf("new job has %d values, hook %d jobs, want 2 and 2", len(j.varsList), len(h.jobs))
+	}
+}
+
+// newTestRunner returns a Runner with a batch hook echoing the changed .go
+// files of a temporary workspace, the workspace, and a function returning
+// the hooks log.
+func newTestRunner(t *testing.T, maxPending int) (*Runner, string, func() string) {
+	d, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(d) })
+
+	cfg := &conf.GobazelConf{
+		GoPkgPrefix: "p.com",
+		Hooks: &conf.HooksConf{
+			QuietWindowDuration: 50 * time.Millisecond,
+			MaxPending:          maxPending,
+			Hooks: []*conf.HookConf{{
+				Name:            "echo",
+				Paths:           []string{"**/*.go"},
+				Events:          conf.HookEvents,
+				Command:         "echo {file}",
+				Batch:           true,
+				Concurrency:     1,
+				TimeoutDuration: time.Minute,
+			}},
+		},
+	}
+	ws := filepath.Join(d, "ws")
+	if err := os.Mkdir(ws, 0755); err != nil {
+		t.Fatal(err)
+	}
+	skip := func(path string) bool { return path == "ignored" }
+	r := NewRunner(cfg, ws, filepath.Join(d, "src"), d, nil, skip)
+	t.Cleanup(r.Stop)
+
+	return r, ws, func() string {
+		b, _ := ioutil.ReadFile(filepath.Join(d, LogFile))
+		return string(b)
+	}
+}
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForLog(t *testing.T, log func() string, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(log(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("log is %q, want %q", log(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	r, _, log := newTestRunner(t, 100)
+
+	r.Add("write", "a/a.go")
+	r.Add("create", "b/b.txt")
+	r.Add("write", "a/a.go")
+	time.Sleep(20 * time.Millisecond)
+	r.Add("create", "b/b.go")
+
+	waitForLog(t, log, "[hook echo] echo a/a.go b/b.go (done)\na/a.go b/b.go\n")
+	if n := strings.Count(log(), "[hook echo]"); n != 1 {
+		t.Errorf("hook ran %d times, want once:\n%s", n, log())
+	}
+
+	r.Add("remove", "c/c.go")
+	waitForLog(t, log, "[hook echo] echo c/c.go (done)")
+}
+
+func TestListing(t *testing.T) {
+	r, ws, _ := newTestRunner(t, 100)
+	for _, f := range []string{"a/a.go", "a/b.go", "a/c.txt", "b/b.go", "ignored/i.go"} {
+		writeFile(t, filepath.Join(ws, f))
+	}
+	r.Scan()
+	if events := r.listing.rescan(); len(events) != 0 {
+		t.Errorf("rescan() = %v without changes", events)
+	}
+
+	// Changes without events.
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(ws, "a", "a.go"), past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(ws, "a", "b.go")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(ws, "b", "new.go"))
+	writeFile(t, filepath.Join(ws, "b", "new.txt"))
+	writeFile(t, filepath.Join(ws, "ignored", "j.go"))
+	if err := os.RemoveAll(filepath.Join(ws, "b")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(ws, "b", "new.go"))
+
+	want := "[{write a/a.go} {remove a/b.go} {remove b/b.go} {create b/new.go}]"
+	if events := r.listing.rescan(); fmt.Sprint(events) != want {
+		t.Errorf("rescan() = %v, want %s", events, want)
+	}
+	if events := r.listing.rescan(); len(events) != 0 {
+		t.Errorf("rescan() = %v again", events)
+	}
+
+	// Events keep the listing up to date.
+	writeFile(t, filepath.Join(ws, "c", "c.go"))
+	r.Add("create", "c/c.go")
+	if err := os.Remove(filepath.Join(ws, "c", "c.go")); err != nil {
+		t.Fatal(err)
+	}
+	want = "[{remove c/c.go}]"
+	if events := r.listing.rescan(); fmt.Sprint(events) != want {
+		t.Errorf("rescan() = %v, want %s", events, want)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	r, ws, log := newTestRunner(t, 2)
+	writeFile(t, filepath.Join(ws, "a", "a.go"))
+	r.Scan()
+
+	writeFile(t, filepath.Join(ws, "a", "new.go"))
+	r.Add("write", "b/b.go")
+	r.Add("write", "c/c.go")
+	r.Add("write", "e/e.go")
+
+	waitForLog(t, log, "[hook echo] echo a/new.go (done)")
+	if strings.Contains(log(), "b/b.go") {
+		t.Errorf("events before the overflow ran:\n%s", log())
+	}
+}
@@ -0,0 +1,140 @@
+package hooks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SkipFunc reports whether the workspace relative path isn't watched, e.g.,
+// an ignored directory.
+type SkipFunc func(path string) bool
+
+// listing keeps the modification times of the files any hook matches, and
+// the directories they are in. After events were lost, only these
+// directories are listed again, and compared with the previous listing.
+type listing struct {
+	workspace string
+	skip      SkipFunc
+	matches   func(path string) bool
+
+	mu    sync.Mutex
+	files map[string]time.Time
+	dirs  map[string]struct{}
+}
+
+// scan walks the workspace for the matching files.
+func (l *listing) scan() {
+	files := map[string]time.Time{}
+	filepath.Walk(l.workspace, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == l.workspace {
+			return nil
+		}
+		rel := path[len(l.workspace)+1:]
+		if l.skip(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && l.matches(rel) {
+			files[rel] = info.ModTime()
+		}
+		return nil
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Events of the meantime are newer.
+	for rel, mtime := range files {
+		if _, ok := l.files[rel]; !ok {
+			l.files[rel] = mtime
+		}
+		l.dirs[filepath.Dir(rel)] = struct{}{}
+	}
+}
+
+// update records the current state of the file after an event.
+func (l *listing) update(path string) {
+	if !l.matches(path) {
+		return
+	}
+	fi, err := os.Stat(filepath.Join(l.workspace, path))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err != nil || !fi.Mode().IsRegular() {
+		delete(l.files, path)
+		return
+	}
+	l.files[path] = fi.ModTime()
+	l.dirs[filepath.Dir(path)] = struct{}{}
+}
+
+// rescan lists the directories of the matching files again, and returns the
+// events of the files created, modified or removed since the last listing.
+// Matching files in other directories show up with their next event.
+func (l *listing) rescan() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	byDir := map[string][]string{}
+	for rel := range l.files {
+		dir := filepath.Dir(rel)
+		byDir[dir] = append(byDir[dir], rel)
+	}
+
+	events := []Event{}
+	for dir := range l.dirs {
+		seen := map[string]struct{}{}
+		fis, err := ioutil.ReadDir(filepath.Join(l.workspace, dir))
+		if err != nil && os.IsNotExist(err) {
+			delete(l.dirs, dir)
+		}
+		for _, fi := range fis {
+			rel := fi.Name()
+			if dir != "." {
+				rel = dir + string(os.PathSeparator) + rel
+			}
+			if !fi.Mode().IsRegular() || !l.matches(rel) {
+				continue
+			}
+			seen[rel] = struct{}{}
+
+			mtime, ok := l.files[rel]
+			switch {
+			case !ok:
+				events = append(events, Event{Kind: "create", Path: rel})
+			case !mtime.Equal(fi.ModTime()):
+				events = append(events, Event{Kind: "write", Path: rel})
+			default:
+				continue
+			}
+			l.files[rel] = fi.ModTime()
+		}
+		for _, rel := range byDir[dir] {
+			if _, ok := seen[rel]; !ok {
+				events = append(events, Event{Kind: "remove", Path: rel})
+				delete(l.files, rel)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Path < events[j].Path })
+	return events
+}
+
+func newListing(workspace string, skip SkipFunc, matches func(path string) bool) *listing {
+	return &listing{
+		workspace: strings.TrimSuffix(workspace, string(os.PathSeparator)),
+		skip:      skip,
+		matches:   matches,
+		files:     map[string]time.Time{},
+		dirs:      map[string]struct{}{},
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/exec"
+	"github.com/linuxerwang/gobazel/gopathfs"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+const (
+	buildIncremental = buildMode("incremental")
+	buildFull        = buildMode("full")
+
+	buildStateFile = "build-state.json"
+)
+
+// buildMode is the value of flag --build: "" (no build), "incremental" or
+// "full". A bare --build is incremental.
+type buildMode string
+
+func (m *buildMode) String() string {
+	return string(*m)
+}
+
+func (m *buildMode) Set(v string) error {
+	switch v {
+	case "true", string(buildIncremental):
+		*m = buildIncremental
+	case string(buildFull):
+		*m = buildFull
+	case "false", "":
+		*m = ""
+	default:
+		return fmt.Errorf("invalid build mode %q, must be incremental or full", v)
+	}
+	return nil
+}
+
+func (m *buildMode) IsBoolFlag() bool {
+	return true
+}
+
+// buildState is the git state of the workspace at the last successful
+// --build.
+type buildState struct {
+	Commit string `json:"commit"`
+	// Dirty are the content hashes of the changed and untracked files, ""
+	// for deleted ones.
+	Dirty map[string]string `json:"dirty"`
+	Time  time.Time         `json:"time"`
+}
+
+// incrementalScope returns the bazel query expression of the targets
+// affected by the changes since the last successful build. It returns false
+// if everything has to be built, e.g., without a previous build or if .bzl
+// files changed.
+func incrementalScope(ctx context.Context, cfg *conf.GobazelConf, dirs *gopathfs.Dirs, bzl *exec.Bazel) (string, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(dirs.StateDir, buildStateFile))
+	if err != nil {
+		return "", false
+	}
+	last := buildState{}
+	if err := json.Unmarshal(b, &last); err != nil || last.Commit == "" {
+		return "", false
+	}
+
+	changed, err := changedSince(dirs.Workspace, &last)
+	if err != nil {
+		fmt.Printf("Failed to find the changes since commit %s, %v.\n", last.Commit, err)
+		return "", false
+	}
+
+	mapper := pathmap.New(cfg, dirs.Workspace, dirs.SrcDir)
+	// Changed BUILD files and deleted files affect the targets of their
+	// (enclosing, if deleted) package.
+	pkgs := map[string]struct{}{}
+	files := []string{}
+	for _, rel := range changed {
+		name := filepath.Base(rel)
+		pkg := mapper.BazelPackage(filepath.Dir(rel))
+		switch {
+		case name == "BUILD", name == "BUILD.bazel":
+			pkgs[pkg] = struct{}{}
+		case exec.IsBuildFile(rel):
+			// Changed macros or external repositories can affect anything.
+			fmt.Printf("%s changed, building everything.\n", rel)
+			return "", false
+		default:
+			if _, err := os.Stat(filepath.Join(dirs.Workspace, rel)); err != nil {
+				pkgs[pkg] = struct{}{}
+				continue
+			}
+			files = append(files, "//"+pkg+":"+strings.TrimPrefix(filepath.ToSlash(rel), pkg+"/"))
+		}
+	}
+
+	labels := []string{}
+	if len(files) > 0 {
+		// Bazel rejects the whole query if one of the labels isn't a target,
+		// e.g., a README. Only the files bazel knows are kept.
+		// With --keep_going, exit code 3 means some labels didn't resolve.
+		targets, err := bzl.Query(ctx, fmt.Sprintf("set(%s)", strings.Join(files, " ")))
+		if ee, ok := err.(*osexec.ExitError); err != nil && (!ok || ee.ExitCode() != 3) {
+			fmt.Printf("Failed to find the changed targets, %v.\n", err)
+			return "", false
+		}
+		labels = append(labels, targets...)
+	}
+	for pkg := range pkgs {
+		if pkg == "" && !isRootPackage(dirs.Workspace) {
+			continue
+		}
+		labels = append(labels, "//"+pkg+":all")
+	}
+
+	if len(labels) == 0 {
+		return "", true
+	}
+	sort.Strings(labels)
+	fmt.Printf("%d files changed since the last build at commit %s.\n", len(changed), last.Commit)
+	return fmt.Sprintf("rdeps(//..., set(%s))", strings.Join(labels, " ")), true
+}
+
+// isRootPackage reports whether the workspace directory has a BUILD file.
+func isRootPackage(workspace string) bool {
+	for _, build := range []string{"BUILD", "BUILD.bazel"} {
+		if _, err := os.Stat(filepath.Join(workspace, build)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// changedSince returns the workspace relative paths of the files changed
+// since the last build.
+func changedSince(workspace string, last *buildState) ([]string, error) {
+	files, err := gitChangedFiles(workspace, last.Commit)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	inDiff := map[string]struct{}{}
+	for _, rel := range files {
+		inDiff[rel] = struct{}{}
+		if hash, ok := last.Dirty[rel]; ok && hash == hashWorkspaceFile(workspace, rel) {
+			// Built in the same state last time.
+			continue
+		}
+		changed = append(changed, rel)
+	}
+	// Files dirty at the last build but reverted since.
+	for rel := range last.Dirty {
+		if _, ok := inDiff[rel]; !ok {
+			changed = append(changed, rel)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// currentBuildState returns the current git state of the workspace.
+func currentBuildState(workspace string) (*buildState, error) {
+	out, err := gitOutput(workspace, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	state := buildState{
+		Commit: strings.TrimSpace(string(out)),
+		Dirty:  map[string]string{},
+		Time:   time.Now(),
+	}
+
+	files, err := gitChangedFiles(workspace, state.Commit)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range files {
+		state.Dirty[rel] = hashWorkspaceFile(workspace, rel)
+	}
+	return &state, nil
+}
+
+func saveBuildState(dirs *gopathfs.Dirs, state *buildState) {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirs.StateDir, buildStateFile), b, 0644); err != nil {
+		fmt.Printf("Failed to save the build state, %v.\n", err)
+	}
+}
+
+// gitChangedFiles returns the workspace relative paths of the files which
+// differ from the given commit, including untracked files.
+func gitChangedFiles(workspace, commit string) ([]string, error) {
+	diff, err := gitOutput(workspace, "diff", "--name-only", "--relative", "-z", commit, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := gitOutput(workspace, "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, out := range [][]byte{diff, untracked} {
+		for _, f := range bytes.Split(out, []byte{0}) {
+			if len(f) > 0 {
+				files = append(files, filepath.FromSlash(string(f)))
+			}
+		}
+	}
+	return files, nil
+}
+
+func gitOutput(workspace string, args ...string) ([]byte, error) {
+	cmd := osexec.Command("git", args...)
+	cmd.Dir = workspace
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed, %v", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func hashWorkspaceFile(workspace, rel string) string {
+	b, err := ioutil.ReadFile(filepath.Join(workspace, rel))
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// affectedGoPackages returns the import paths of the first party Go packages
+// with targets in the given labels.
+func affectedGoPackages(cfg *conf.GobazelConf, projects, labels []string) []string {
+	pkgs := []string{}
+	seen := map[string]struct{}{}
+	for _, label := range labels {
+		dir, _ := exec.SplitLabel(label)
+		if _, ok := seen[dir]; ok || !inProjects(cfg, projects, dir) {
+			continue
+		}
+		seen[dir] = struct{}{}
+		pkgs = append(pkgs, filepath.Join(cfg.GoPkgPrefix, dir))
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+func inProjects(cfg *conf.GobazelConf, projects []string, dir string) bool {
+	for _, v := range cfg.Vendors {
+		if dir == v || strings.HasPrefix(dir, v+"/") {
+			return false
+		}
+	}
+	for _, proj := range projects {
+		if dir == proj || strings.HasPrefix(dir, proj+"/") {
+			return true
+		}
+	}
+	return false
+}
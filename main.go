@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -14,14 +15,17 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/linuxerwang/gobazel/bep"
 	"github.com/linuxerwang/gobazel/conf"
 	"github.com/linuxerwang/gobazel/exec"
 	"github.com/linuxerwang/gobazel/gopathfs"
 )
 
-const (
+var (
+	// initialConf is written to a new .gobazelrc, with the hooks used
+	// without a hooks section.
 	initialConf = `gobazel {
     go-path: ""
     go-pkg-prefix: "test.com"
@@ -36,6 +40,13 @@ const (
             "bazel-.*",
             "third-party.*",
         ]
+        queries: [
+        ]
+        keep-going: true
+        flags: [
+        ]
+        configs: [
+        ]
     }
 
     vendor-dirs: [
@@ -50,20 +61,23 @@ const (
     fall-through-dirs: [
         ".vscode",
     ]
-}
+
+` + conf.DefaultHooksSection("    ") + `}
 `
-	bzlQuery = "kind(%s, deps(%s/...))"
 )
 
 const (
-	gobzlPidFile = ".gobazelpid"
-	gobzlRcFile  = ".gobazelrc"
-	bzlWsFile    = "WORKSPACE"
+	gobzlPidFile    = ".gobazelpid"
+	gobzlDlvPidFile = ".gobazeldlvpid"
+	gobzlRcFile     = ".gobazelrc"
+	gobzlStateDir   = ".gobazel"
+	gobzlWsFile     = "workspace"
+	bzlWsFile       = "WORKSPACE"
 )
 
 var (
 	debug    = flag.Bool("debug", false, "Enable debug output.")
-	build    = flag.Bool("build", false, "Build all packages.")
+	build    = buildMode("")
 	daemon   = flag.Bool("daemon", true, "To detach from parent process.")
 	detached = flag.Bool("detached", false, "The current process has been detached from parent process. Do not set it manually, it's only used by gobazel to detach itself.")
 
@@ -72,6 +86,8 @@ var (
 )
 
 func init() {
+	flag.Var(&build, "build", "Build the packages changed since the last build, or all packages with --build=full.")
+
 	dirs = gopathfs.Dirs{}
 
 	wd, err := os.Getwd()
@@ -80,10 +96,34 @@ func init() {
 		os.Exit(2)
 	}
 
-	// The command has to be executed in a bazel workspace.
-	dirs.Workspace = wd
-	dirs.GobzlConf = filepath.Join(wd, gobzlRcFile)
-	dirs.GobzlPid = filepath.Join(wd, gobzlPidFile)
+	// The command has to be executed in a bazel workspace, or in the virtual
+	// GOPATH of a workspace.
+	dirs.Workspace = findWorkspace(wd)
+	dirs.GobzlConf = filepath.Join(dirs.Workspace, gobzlRcFile)
+	dirs.GobzlPid = filepath.Join(dirs.Workspace, gobzlPidFile)
+}
+
+// findWorkspace returns the bazel workspace containing the given directory.
+// Inside a virtual GOPATH it's the workspace the GOPATH was mounted for.
+func findWorkspace(wd string) string {
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, gobzlStateDir, gobzlWsFile)); err == nil {
+			return strings.TrimSpace(string(b))
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, bzlWsFile)); err == nil {
+			return dir
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return wd
 }
 
 func usage() {
@@ -93,9 +133,24 @@ Usage:
 	gobazel [options]
 	OR to show its version:
 	gobazel version
+	OR to generate a VS Code debug configuration for a bazel built binary:
+	gobazel debug-config [--host=<host>] [--port=<port>] [--output=<launch.json>] <bazel-bin path or label>
+	OR to build a bazel target with "-c dbg" and serve it with a headless dlv:
+	gobazel debug [--host=<host>] [--port=<port>] [--output=<launch.json>] <bazel label> [-- <args>]
+	OR to rewrite bazel paths from stdin to virtual GOPATH paths on stdout:
+	gobazel filter
+	OR to run bazel with its output paths rewritten to virtual GOPATH paths:
+	gobazel bazel <bazel args>
+	OR to run bazel on Go package patterns, e.g., "./..." or "mycompany.com/foo/...":
+	gobazel test|build|run [bazel flags] <patterns> [-- <args>]
+	OR to print the results in bazel-testlogs as "go test -json" does:
+	gobazel test-json <patterns>
+	OR to run bazel coverage and map the report into the virtual GOPATH:
+	gobazel coverage [--lcov=<file>] [--coverprofile=<file>] [bazel flags] <patterns>
 
 Note:
 	This command has to be executed in a bazel workspace (where your WORKSPACE file reside).
+	The subcommands can also be executed in the virtual GOPATH.
 
 Options:`)
 
@@ -130,6 +185,32 @@ func main() {
 
 	cfg := loadConfig()
 
+	if flag.NArg() > 0 {
+		switch strings.ToLower(flag.Arg(0)) {
+		case "debug-config":
+			debugConfig(cfg, flag.Args()[1:])
+			return
+		case "debug":
+			debugRun(cfg, flag.Args()[1:])
+			return
+		case "filter":
+			filter(cfg)
+			return
+		case "bazel":
+			bazelWrapper(cfg, flag.Args()[1:])
+			return
+		case "test", "build", "run":
+			goCommand(cfg, strings.ToLower(flag.Arg(0)), flag.Args()[1:])
+			return
+		case "test-json":
+			testJSON(cfg, flag.Args()[1:])
+			return
+		case "coverage":
+			coverageCmd(cfg, flag.Args()[1:])
+			return
+		}
+	}
+
 	if _, err := os.Stat(filepath.Join(dirs.Workspace, gobzlPidFile)); !os.IsNotExist(err) {
 		fmt.Println("File .gobazelpid for another gobazel process exists. Start IDE")
 		startIDE(cfg)
@@ -148,8 +229,7 @@ func main() {
 
 
 	// Create a FUSE virtual file system on dirs.SrcDir.
-	nfs := pathfs.NewPathNodeFs(gopathfs.NewGoPathFs(*debug, cfg, &dirs), nil)
-	server, _, err := nodefs.MountRoot(dirs.SrcDir, nfs.Root(), nil)
+	server, gpfs, err := mount(cfg)
 	if err != nil {
 		fmt.Printf("Mount fail: %v\n", err)
 		os.Exit(2)
@@ -172,6 +252,7 @@ func main() {
 				fmt.Println("Error to unmount,", err)
 				continue
 			}
+			gpfs.OnUnmount()
 			os.Exit(0)
 		}
 	}()
@@ -179,17 +260,18 @@ func main() {
 	go func() {
 		time.Sleep(time.Second)
 
-		// If set to build all packages.
-		if *build {
-			fmt.Println("\nBuilding all package, it may take seconds to a few minutes, depending on how many pakcages you have ...")
+		// If set to build packages.
+		if build != "" {
+			fmt.Println("\nBuilding packages, it may take seconds to a few minutes, depending on how many pakcages you have ...")
 
 			if cfg.Build == nil {
 				fmt.Println("No build config found in .gobazelrc, ignored.")
 				return
 			}
 
-			// Best effort run, errors are ignored.
-			bazelBuild(cfg, &dirs)
+			if err := bazelBuild(cfg, &dirs, build); err != nil {
+				fmt.Println("Build failed,", err)
+			}
 		}
 
 		// If a Go IDE is specified, start it with the proper GOPATH.
@@ -199,7 +281,33 @@ func main() {
 		}
 	}()
 
-	server.Serve()
+	server.Wait()
+}
+
+// mount mounts the virtual GOPATH and serves it in the background, the
+// changes of the real trees are watched once the kernel mounted it.
+func mount(cfg *conf.GobazelConf) (*fuse.Server, *gopathfs.GoPathFs, error) {
+	gpfs := gopathfs.NewGoPathFs(*debug, cfg, &dirs)
+
+	// Changes are invalidated in the kernel, so it can cache longer.
+	kc := cfg.KernelCache
+	opts := fs.Options{
+		EntryTimeout:    &kc.EntryTimeoutDuration,
+		AttrTimeout:     &kc.AttrTimeoutDuration,
+		NegativeTimeout: &kc.NegativeTimeoutDuration,
+		RootStableAttr:  &fs.StableAttr{Ino: 1},
+	}
+	server, err := fuse.NewServer(fs.NewNodeFS(gopathfs.NewRoot(gpfs), &opts), dirs.SrcDir, &opts.MountOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	go server.Serve()
+	if err := server.WaitMount(); err != nil {
+		server.Unmount()
+		return nil, nil, err
+	}
+	gpfs.OnMount()
+	return server, gpfs, nil
 }
 
 func loadConfig() *conf.GobazelConf {
@@ -234,67 +342,174 @@ func loadConfig() *conf.GobazelConf {
 	os.Mkdir(dirs.PkgDir, 0755)
 	dirs.SrcDir = filepath.Join(cfg.GoPath, "src")
 	os.Mkdir(dirs.SrcDir, 0755)
+	dirs.StateDir = filepath.Join(cfg.GoPath, gobzlStateDir)
+	os.Mkdir(dirs.StateDir, 0755)
+	dirs.GenfilesDir = exec.NewBazel(cfg, dirs.Workspace, dirs.StateDir, nil).GenfilesDir()
+
+	// Remember the workspace so that gobazel can also run in the virtual
+	// GOPATH.
+	ioutil.WriteFile(filepath.Join(dirs.StateDir, gobzlWsFile), []byte(dirs.Workspace+"\n"), 0644)
 
 	return cfg
 }
 
-func bazelBuild(cfg *conf.GobazelConf, dirs *gopathfs.Dirs) {
-	ignoreRegexes := make([]*regexp.Regexp, len(cfg.Build.Ignores))
-	for i, ign := range cfg.Build.Ignores {
-		ignoreRegexes[i] = regexp.MustCompile(ign)
+// bazelBuild builds the targets of the build config with one bazel build,
+// then runs go install for the first party Go packages. In incremental mode
+// only the targets and packages affected by the changes since the last
+// successful build are built.
+func bazelBuild(cfg *conf.GobazelConf, dirs *gopathfs.Dirs, mode buildMode) error {
+	projects, err := buildProjects(cfg, dirs)
+	if err != nil {
+		return err
 	}
 
-	f, err := os.Open(dirs.Workspace)
+	ctx := context.Background()
+	bzl := exec.NewBazel(cfg, dirs.Workspace, dirs.StateDir, bep.NewRecorder(dirs.StateDir, newRewriter(cfg)))
+	bzl.WaitIdle(ctx)
+
+	state, err := currentBuildState(dirs.Workspace)
 	if err != nil {
-		fmt.Println("Failed to read workspace,", err)
-		os.Exit(2)
+		fmt.Printf("Failed to get the git state, incremental builds are disabled, %v.\n", err)
 	}
-	defer f.Close()
 
-	fis, err := f.Readdir(-1)
+	scope := ""
+	if mode == buildIncremental && state != nil {
+		// Without a scope everything is built.
+		var ok bool
+		if scope, ok = incrementalScope(ctx, cfg, dirs, bzl); ok && scope == "" {
+			fmt.Println("No changes since the last build.")
+			saveBuildState(dirs, state)
+			return nil
+		}
+	}
+
+	// Targets of packages which failed to load are missing from partial
+	// query results, the rest is still built.
+	var queryErr, buildErr error
+	if expr := buildQuery(cfg.Build, projects); expr != "" {
+		if scope != "" {
+			expr = fmt.Sprintf("(%s) intersect %s", expr, scope)
+		}
+		fmt.Printf("bazel query %s", expr)
+		targets, err := bzl.Query(ctx, expr)
+		if err != nil && len(targets) == 0 {
+			fmt.Println(" (failed!)")
+			return fmt.Errorf("bazel query %s failed, %v", expr, err)
+		}
+		if err != nil {
+			fmt.Printf(" (%d targets, partial!)\n", len(targets))
+			queryErr = fmt.Errorf("bazel query %s failed, %v", expr, err)
+		} else {
+			fmt.Printf(" (%d targets)\n", len(targets))
+		}
+
+		if len(targets) > 0 {
+			b, err := bzl.Build(ctx, targets, buildFlags(cfg.Build)...)
+			printBuildSummary(dirs, b, len(targets))
+			if err != nil {
+				buildErr = fmt.Errorf("bazel build failed, %v", err)
+			}
+		}
+	}
+
+	var installErr error
+	if scope != "" {
+		// Only go install the Go packages affected by the changes.
+		expr := fmt.Sprintf(`kind("^go_.* rule$", %s)`, scope)
+		labels, err := bzl.Query(ctx, expr)
+		if err != nil && len(labels) == 0 {
+			return fmt.Errorf("bazel query %s failed, %v", expr, err)
+		}
+		if err != nil && queryErr == nil {
+			queryErr = fmt.Errorf("bazel query %s failed, %v", expr, err)
+		}
+		installErr = exec.RunGoInstalls(ctx, cfg, affectedGoPackages(cfg, projects, labels))
+	} else {
+		// Run go install for all first party projects.
+		installErr = exec.RunGoWalkInstall(ctx, cfg, dirs.Workspace, projects)
+	}
+
+	// Failed packages are retried once their files change again.
+	if state != nil && buildErr == nil {
+		saveBuildState(dirs, state)
+	}
+	if buildErr != nil {
+		return buildErr
+	}
+	if installErr != nil {
+		return installErr
+	}
+	return queryErr
+}
+
+// buildProjects returns the top level directories of the workspace which
+// aren't ignored by the build config.
+func buildProjects(cfg *conf.GobazelConf, dirs *gopathfs.Dirs) ([]string, error) {
+	ignoreRegexes := make([]*regexp.Regexp, len(cfg.Build.Ignores))
+	for i, ign := range cfg.Build.Ignores {
+		ignoreRegexes[i] = regexp.MustCompile(ign)
+	}
+
+	fis, err := ioutil.ReadDir(dirs.Workspace)
 	if err != nil {
-		fmt.Println("Failed to read workspace,", err)
-		os.Exit(2)
+		return nil, fmt.Errorf("failed to read workspace, %v", err)
 	}
 
-	targets := map[string]struct{}{}
 	projects := []string{}
-
 outterLoop:
 	for _, fi := range fis {
-		fmt.Printf("Folder %s ... ", fi.Name())
 		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
-			fmt.Println("ignored.")
 			continue
 		}
-
 		for _, re := range ignoreRegexes {
 			if re.MatchString(fi.Name()) {
-				fmt.Println("ignored.")
 				continue outterLoop
 			}
 		}
-
 		projects = append(projects, fi.Name())
+	}
+	return projects, nil
+}
 
-		// Check if there are given bazel build targets in this directory.
-		cmd := [4]string{"bazel", "query", "--keep_going", ""}
-		for _, rule := range cfg.Build.Rules {
-			cmd[3] = fmt.Sprintf(bzlQuery, rule, fi.Name())
-			exec.RunBazelQuery(dirs.Workspace, fi.Name(), cmd[:], targets)
+// buildQuery returns the union of the configured query expressions. Without
+// any, it selects the targets of the configured rules in the projects.
+func buildQuery(bc *conf.BuildConf, projects []string) string {
+	exprs := []string{}
+	for _, q := range bc.Queries {
+		exprs = append(exprs, "("+q+")")
+	}
+	if len(exprs) == 0 && len(bc.Rules) > 0 && len(projects) > 0 {
+		pkgs := make([]string, len(projects))
+		for i, proj := range projects {
+			pkgs[i] = "//" + proj + "/..."
 		}
+		exprs = append(exprs, fmt.Sprintf("kind(\"%s\", %s)", strings.Join(bc.Rules, "|"), strings.Join(pkgs, " + ")))
+	}
+	return strings.Join(exprs, " + ")
+}
 
-		fmt.Println("done.")
+func buildFlags(bc *conf.BuildConf) []string {
+	flags := []string{}
+	if bc.KeepGoing {
+		flags = append(flags, "--keep_going")
 	}
+	for _, c := range bc.Configs {
+		flags = append(flags, "--config="+c)
+	}
+	return append(flags, bc.Flags...)
+}
 
-	// Execute bazel build.
-	for target := range targets {
-		exec.RunBazelBuild(dirs.Workspace, target)
+func printBuildSummary(dirs *gopathfs.Dirs, b *bep.Build, total int) {
+	if b == nil {
+		return
 	}
 
-	// Run go install for all first party projects.
-	for _, proj := range projects {
-		exec.RunGoWalkInstall(cfg, dirs.Workspace, proj)
+	fmt.Printf("\nBuild summary: %d targets, %d failed, %.1fs.\n", total, len(b.Failed), b.Elapsed)
+	for _, label := range b.Failed {
+		fmt.Printf("    %s\n", label)
+	}
+	if len(b.Failed) > 0 {
+		fmt.Printf("The errors are in %s.\n", filepath.Join(dirs.StateDir, bep.StatusFile))
 	}
 }
 
@@ -316,6 +531,8 @@ func detach() (int, error) {
 }
 
 func stopExistingProcess() {
+	stopDebugger()
+
 	pidFile := filepath.Join(dirs.Workspace, gobzlPidFile)
 	if _, err := os.Stat(pidFile); err != nil {
 		fmt.Printf("There is no file .gobazelpid in workspace %s.\n", dirs.Workspace)
@@ -361,3 +578,22 @@ func startIDE(cfg *conf.GobazelConf) {
 		fmt.Println("Error to run IDE, ", err)
 	}
 }
+
+// stopDebugger stops the dlv server started by "gobazel debug", if any.
+func stopDebugger() {
+	pidFile := filepath.Join(dirs.Workspace, gobzlDlvPidFile)
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return
+	}
+	defer os.Remove(pidFile)
+
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 32)
+	if err != nil {
+		return
+	}
+	if p, err := os.FindProcess(int(pid)); err == nil {
+		fmt.Printf("Stopping dlv process %d.\n", pid)
+		p.Signal(syscall.SIGTERM)
+	}
+}
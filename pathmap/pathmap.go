@@ -0,0 +1,157 @@
+package pathmap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linuxerwang/gobazel/conf"
+)
+
+var (
+	pathSeparator = string(os.PathSeparator)
+)
+
+// Mapper maps paths in the bazel workspace to their locations in the
+// virtual GOPATH, the same way GoPathFs lays them out.
+type Mapper struct {
+	cfg       *conf.GobazelConf
+	workspace string
+	srcDir    string
+}
+
+// Virtual returns the virtual GOPATH path for the given workspace relative
+// path.
+func (m *Mapper) Virtual(rel string) string {
+	rel = filepath.Clean(rel)
+	if rel == "." {
+		rel = ""
+	}
+
+	// Fall-through directories are mapped as is.
+	for _, dir := range m.cfg.FallThrough {
+		if rel == dir || strings.HasPrefix(rel, dir+pathSeparator) {
+			return filepath.Join(m.srcDir, rel)
+		}
+	}
+
+	// Vendor directories are mapped to the top of GOPATH/src.
+	for _, vendor := range m.cfg.Vendors {
+		if rel == vendor || strings.HasPrefix(rel, vendor+pathSeparator) {
+			return filepath.Join(m.srcDir, rel[len(vendor):])
+		}
+	}
+
+	return filepath.Join(m.srcDir, m.cfg.GoPkgPrefix, rel)
+}
+
+// Rel returns the workspace relative path of a path in the workspace, in
+// the execroot (or a sandbox) or in the bazel output tree. Generated files
+// are mapped to their package directories.
+func (m *Mapper) Rel(p string) (string, bool) {
+	p = filepath.Clean(p)
+	if filepath.IsAbs(p) {
+		switch {
+		case execRootRe.MatchString(p):
+			p = p[len(execRootRe.FindString(p)):]
+		case strings.HasPrefix(p, m.workspace+pathSeparator):
+			p = p[len(m.workspace)+1:]
+		default:
+			return "", false
+		}
+	}
+
+	if out := outDirRe.FindString(p); out != "" {
+		p = p[len(out):]
+	}
+	return p, true
+}
+
+// ImportPath returns the Go import path of the given workspace relative
+// directory.
+func (m *Mapper) ImportPath(rel string) string {
+	ip, err := filepath.Rel(m.srcDir, m.Virtual(rel))
+	if err != nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(ip)
+}
+
+// ImportPathDir returns the workspace relative directory of the given Go
+// import path. Third party import paths are searched in the vendor
+// directories.
+func (m *Mapper) ImportPathDir(importPath string) (string, bool) {
+	importPath = strings.Trim(importPath, "/")
+	if importPath == m.cfg.GoPkgPrefix {
+		return "", true
+	}
+	if strings.HasPrefix(importPath, m.cfg.GoPkgPrefix+"/") {
+		return importPath[len(m.cfg.GoPkgPrefix)+1:], true
+	}
+
+	for _, vendor := range m.cfg.Vendors {
+		dir := filepath.Join(vendor, importPath)
+		if fi, err := os.Stat(filepath.Join(m.workspace, dir)); err == nil && fi.IsDir() {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// VirtualDir returns the workspace relative directory of the given
+// directory in the virtual GOPATH.
+func (m *Mapper) VirtualDir(virtual string) (string, bool) {
+	rel, err := filepath.Rel(m.srcDir, virtual)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+pathSeparator) {
+		return "", false
+	}
+	if rel == "." {
+		return "", false
+	}
+
+	for _, dir := range m.cfg.FallThrough {
+		if rel == dir || strings.HasPrefix(rel, dir+pathSeparator) {
+			return rel, true
+		}
+	}
+	return m.ImportPathDir(filepath.ToSlash(rel))
+}
+
+// BazelPackage returns the bazel package containing the workspace relative
+// directory, i.e., the closest directory with a BUILD file. The root package
+// is "".
+func (m *Mapper) BazelPackage(dir string) string {
+	for d := filepath.Clean(dir); d != "." && d != pathSeparator; d = filepath.Dir(d) {
+		for _, build := range []string{"BUILD", "BUILD.bazel"} {
+			if _, err := os.Stat(filepath.Join(m.workspace, d, build)); err == nil {
+				return filepath.ToSlash(d)
+			}
+		}
+	}
+	return ""
+}
+
+// GoRoot returns the virtual GOPATH path of the Go SDK.
+func (m *Mapper) GoRoot() string {
+	return filepath.Join(m.srcDir, m.cfg.GoPkgPrefix, "GOROOT")
+}
+
+// SrcDir returns the virtual GOPATH src directory.
+func (m *Mapper) SrcDir() string {
+	return m.srcDir
+}
+
+// Workspace returns the bazel workspace directory.
+func (m *Mapper) Workspace() string {
+	return m.workspace
+}
+
+// New returns a new Mapper for the given bazel workspace and virtual GOPATH
+// src directory.
+func New(cfg *conf.GobazelConf, workspace, srcDir string) *Mapper {
+	return &Mapper{
+		cfg:       cfg,
+		workspace: workspace,
+		srcDir:    srcDir,
+	}
+}
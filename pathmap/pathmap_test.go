@@ -0,0 +1,141 @@
+package pathmap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxerwang/gobazel/conf"
+)
+
+const testExecRoot = "/home/u/.cache/bazel/_bazel_u/0123/execroot/__main__"
+
+// newTestMapper returns a Mapper of a workspace with the prefix "p.com",
+// vendor directory "third_party" and fall-through directory "ft", mapped
+// to /gopath/src.
+func newTestMapper(t *testing.T) *Mapper {
+	ws, err := ioutil.TempDir("", "pathmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(ws) })
+
+	for _, f := range []string{
+		"a/BUILD",
+		"a/a.go",
+		"a/sub/s.go",
+		"third_party/github.com/x/x.go",
+		"ft/f.go",
+	} {
+		path := filepath.Join(ws, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &conf.GobazelConf{
+		GoPkgPrefix: "p.com",
+		Vendors:     []string{"third_party"},
+		FallThrough: []string{"ft"},
+	}
+	return New(cfg, ws, "/gopath/src")
+}
+
+func TestVirtual(t *testing.T) {
+	m := newTestMapper(t)
+	for _, tc := range []struct {
+		rel, want string
+	}{
+		{"", "/gopath/src/p.com"},
+		{".", "/gopath/src/p.com"},
+		{"a/a.go", "/gopath/src/p.com/a/a.go"},
+		{"third_party/github.com/x/x.go", "/gopath/src/github.com/x/x.go"},
+		{"third_partyx/y.go", "/gopath/src/p.com/third_partyx/y.go"},
+		{"ft/f.go", "/gopath/src/ft/f.go"},
+	} {
+		if got := m.Virtual(tc.rel); got != tc.want {
+			t.Errorf("Virtual(%q) = %q, want %q", tc.rel, got, tc.want)
+		}
+	}
+}
+
+func TestRel(t *testing.T) {
+	m := newTestMapper(t)
+	for _, tc := range []struct {
+		path, want string
+		ok         bool
+	}{
+		{testExecRoot + "/a/a.go", "a/a.go", true},
+		{"/home/u/.cache/bazel/_bazel_u/0123/sandbox/linux-sandbox/7/execroot/__main__/a/a.go", "a/a.go", true},
+		{testExecRoot + "/bazel-out/k8-fastbuild/bin/a/a.pb.go", "a/a.pb.go", true},
+		{m.workspace + "/a/a.go", "a/a.go", true},
+		{"bazel-out/k8-fastbuild/genfiles/a/a.pb.go", "a/a.pb.go", true},
+		{"bazel-bin/a/a.pb.go", "a/a.pb.go", true},
+		{"a/a.go", "a/a.go", true},
+		{"/usr/lib/go/src/fmt/print.go", "", false},
+	} {
+		got, ok := m.Rel(tc.path)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("Rel(%q) = %q, %v, want %q, %v", tc.path, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestImportPaths(t *testing.T) {
+	m := newTestMapper(t)
+	for _, tc := range []struct {
+		rel, importPath string
+	}{
+		{"a", "p.com/a"},
+		{"a/sub", "p.com/a/sub"},
+		{"third_party/github.com/x", "github.com/x"},
+	} {
+		if got := m.ImportPath(tc.rel); got != tc.importPath {
+			t.Errorf("ImportPath(%q) = %q, want %q", tc.rel, got, tc.importPath)
+		}
+		if got, ok := m.ImportPathDir(tc.importPath); got != tc.rel || !ok {
+			t.Errorf("ImportPathDir(%q) = %q, %v, want %q, true", tc.importPath, got, ok, tc.rel)
+		}
+	}
+	if got, ok := m.ImportPathDir("github.com/missing"); ok {
+		t.Errorf("ImportPathDir(github.com/missing) = %q, true, want false", got)
+	}
+}
+
+func TestVirtualDir(t *testing.T) {
+	m := newTestMapper(t)
+	for _, tc := range []struct {
+		virtual, want string
+		ok            bool
+	}{
+		{"/gopath/src/p.com/a/sub", "a/sub", true},
+		{"/gopath/src/github.com/x", "third_party/github.com/x", true},
+		{"/gopath/src/ft", "ft", true},
+		{"/gopath/src", "", false},
+		{"/elsewhere/a", "", false},
+	} {
+		got, ok := m.VirtualDir(tc.virtual)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("VirtualDir(%q) = %q, %v, want %q, %v", tc.virtual, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestBazelPackage(t *testing.T) {
+	m := newTestMapper(t)
+	for _, tc := range []struct {
+		dir, want string
+	}{
+		{"a", "a"},
+		{"a/sub", "a"},
+		{"ft", ""},
+	} {
+		if got := m.BazelPackage(tc.dir); got != tc.want {
+			t.Errorf("BazelPackage(%q) = %q, want %q", tc.dir, got, tc.want)
+		}
+	}
+}
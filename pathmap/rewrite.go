@@ -0,0 +1,188 @@
+package pathmap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	pathRe     = regexp.MustCompile(`[A-Za-z0-9_.+@~/-]*/[A-Za-z0-9_.+@~/-]*`)
+	execRootRe = regexp.MustCompile(`^.*/execroot/[^/]+/`)
+	outDirRe   = regexp.MustCompile(`^(bazel-out/[^/]+/(bin|genfiles)|bazel-bin|bazel-genfiles)/`)
+	goSDKRe    = regexp.MustCompile(`^(.*/)?external/go_sdk/`)
+)
+
+// maxCachedFiles bounds the cache of the relative paths checked for being
+// workspace files.
+const maxCachedFiles = 10000
+
+// Rewriter rewrites execroot, sandbox, bazel-out and workspace paths in
+// text to their virtual GOPATH equivalents.
+type Rewriter struct {
+	mapper   *Mapper
+	goSDKDir string
+
+	mu sync.Mutex
+	// tops are the top level directories of the workspace, read once.
+	tops  map[string]struct{}
+	files map[string]bool
+}
+
+// Rewrite returns the line with all recognized paths rewritten.
+func (r *Rewriter) Rewrite(line string) string {
+	return pathRe.ReplaceAllStringFunc(line, r.rewritePath)
+}
+
+// Writer returns a writer which rewrites every complete line written to it
+// and passes it on to w. Close flushes the last incomplete line.
+func (r *Rewriter) Writer(w io.Writer) io.WriteCloser {
+	return &lineWriter{r: r, w: w}
+}
+
+func (r *Rewriter) rewritePath(p string) string {
+	if strings.HasPrefix(p, r.mapper.srcDir+pathSeparator) {
+		// Already a virtual GOPATH path.
+		return p
+	}
+
+	if filepath.IsAbs(p) {
+		switch {
+		case r.goSDKDir != "" && strings.HasPrefix(p, r.goSDKDir+pathSeparator):
+			return filepath.Join(r.mapper.GoRoot(), p[len(r.goSDKDir):])
+		case execRootRe.MatchString(p):
+			if v, ok := r.mapRel(p[len(execRootRe.FindString(p)):]); ok {
+				return v
+			}
+		case strings.HasPrefix(p, r.mapper.workspace+pathSeparator):
+			if v, ok := r.mapRel(p[len(r.mapper.workspace)+1:]); ok {
+				return v
+			}
+		case goSDKRe.MatchString(p):
+			return filepath.Join(r.mapper.GoRoot(), p[len(goSDKRe.FindString(p)):])
+		}
+		return p
+	}
+
+	rel := strings.TrimPrefix(p, "./")
+	if outDirRe.MatchString(rel) || goSDKRe.MatchString(rel) || strings.HasPrefix(rel, "GOROOT/") {
+		if v, ok := r.mapRel(rel); ok {
+			return v
+		}
+		return p
+	}
+
+	// Other relative paths are only rewritten if they name a file in the
+	// workspace, e.g., in compiler errors.
+	if r.isWorkspaceFile(rel) {
+		if v, ok := r.mapRel(rel); ok {
+			return v
+		}
+	}
+	return p
+}
+
+// isWorkspaceFile reports whether the relative path is a file in the
+// workspace. Only paths in a top level directory of the workspace are
+// checked, and the results are cached, so noisy output doesn't stat every
+// token.
+func (r *Rewriter) isWorkspaceFile(rel string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tops == nil {
+		r.tops = map[string]struct{}{}
+		fis, _ := ioutil.ReadDir(r.mapper.workspace)
+		for _, fi := range fis {
+			if fi.IsDir() {
+				r.tops[fi.Name()] = struct{}{}
+			}
+		}
+	}
+	if _, ok := r.tops[strings.SplitN(rel, "/", 2)[0]]; !ok {
+		return false
+	}
+
+	if isFile, ok := r.files[rel]; ok {
+		return isFile
+	}
+	if len(r.files) >= maxCachedFiles {
+		r.files = map[string]bool{}
+	}
+	fi, err := os.Stat(filepath.Join(r.mapper.workspace, rel))
+	r.files[rel] = err == nil && !fi.IsDir()
+	return r.files[rel]
+}
+
+// mapRel maps a path relative to the workspace (or the execroot).
+func (r *Rewriter) mapRel(rel string) (string, bool) {
+	if m := outDirRe.FindString(rel); m != "" {
+		rel = rel[len(m):]
+	}
+
+	switch {
+	case strings.HasPrefix(rel, "GOROOT/"):
+		return filepath.Join(r.mapper.GoRoot(), rel[len("GOROOT/"):]), true
+	case strings.HasPrefix(rel, "external/go_sdk/"):
+		return filepath.Join(r.mapper.GoRoot(), rel[len("external/go_sdk/"):]), true
+	case strings.HasPrefix(rel, "external/"), strings.HasPrefix(rel, "bazel-"):
+		// Other external repositories and bazel links are not mapped into
+		// the virtual GOPATH.
+		return "", false
+	}
+
+	return r.mapper.Virtual(rel), true
+}
+
+type lineWriter struct {
+	mu  sync.Mutex
+	r   *Rewriter
+	w   io.Writer
+	buf []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lw.buf = append(lw.buf, p...)
+	for {
+		idx := bytes.IndexByte(lw.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		line := lw.r.Rewrite(string(lw.buf[:idx+1]))
+		lw.buf = lw.buf[idx+1:]
+		if _, err := io.WriteString(lw.w, line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (lw *lineWriter) Close() error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if len(lw.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(lw.w, lw.r.Rewrite(string(lw.buf)))
+	lw.buf = nil
+	return err
+}
+
+// NewRewriter returns a new Rewriter. goSDKDir is the go-sdk in bazel
+// external folder, if known.
+func NewRewriter(mapper *Mapper, goSDKDir string) *Rewriter {
+	return &Rewriter{
+		mapper:   mapper,
+		goSDKDir: goSDKDir,
+		files:    map[string]bool{},
+	}
+}
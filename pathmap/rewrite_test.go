@@ -0,0 +1,107 @@
+package pathmap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	m := newTestMapper(t)
+	r := NewRewriter(m, "/home/u/.cache/bazel/_bazel_u/0123/external/go_sdk")
+
+	for _, tc := range []struct {
+		name, line, want string
+	}{
+		{
+			"execroot",
+			testExecRoot + "/a/a.go:12:3: undefined: x\n",
+			"/gopath/src/p.com/a/a.go:12:3: undefined: x\n",
+		},
+		{
+			"sandbox",
+			"/tmp/cache/sandbox/linux-sandbox/7/execroot/__main__/third_party/github.com/x/x.go:1: bad",
+			"/gopath/src/github.com/x/x.go:1: bad",
+		},
+		{
+			"bazel-out",
+			"bazel-out/k8-fastbuild/bin/a/a.pb.go:4:2: syntax error",
+			"/gopath/src/p.com/a/a.pb.go:4:2: syntax error",
+		},
+		{
+			"bazel-genfiles",
+			"see ./bazel-genfiles/a/a.pb.go",
+			"see /gopath/src/p.com/a/a.pb.go",
+		},
+		{
+			"go sdk",
+			"\t/home/u/.cache/bazel/_bazel_u/0123/external/go_sdk/src/runtime/panic.go:770 +0x132",
+			"\t/gopath/src/p.com/GOROOT/src/runtime/panic.go:770 +0x132",
+		},
+		{
+			"go sdk in a sandbox",
+			"/tmp/sandbox/execroot/__main__/external/go_sdk/src/fmt/print.go:5",
+			"/gopath/src/p.com/GOROOT/src/fmt/print.go:5",
+		},
+		{
+			"relative go sdk",
+			"external/go_sdk/src/fmt/print.go:5 and GOROOT/src/os/file.go:3",
+			"/gopath/src/p.com/GOROOT/src/fmt/print.go:5 and /gopath/src/p.com/GOROOT/src/os/file.go:3",
+		},
+		{
+			"workspace",
+			m.workspace + "/ft/f.go:1",
+			"/gopath/src/ft/f.go:1",
+		},
+		{
+			"relative workspace files",
+			"a/a.go:3:1: x declared and not used (a/missing.go, nope/a.go)",
+			"/gopath/src/p.com/a/a.go:3:1: x declared and not used (a/missing.go, nope/a.go)",
+		},
+		{
+			"relative directories",
+			"in a/sub and a/sub/s.go",
+			"in a/sub and /gopath/src/p.com/a/sub/s.go",
+		},
+		{
+			"other external repositories",
+			"external/com_github_x/x.go:1 " + testExecRoot + "/external/com_github_x/x.go:1",
+			"external/com_github_x/x.go:1 " + testExecRoot + "/external/com_github_x/x.go:1",
+		},
+		{
+			"virtual",
+			"/gopath/src/p.com/a/a.go:1",
+			"/gopath/src/p.com/a/a.go:1",
+		},
+		{
+			"unknown",
+			"/usr/include/stdio.h:1 and 1/2",
+			"/usr/include/stdio.h:1 and 1/2",
+		},
+	} {
+		if got := r.Rewrite(tc.line); got != tc.want {
+			t.Errorf("%s: Rewrite(%q) =\n%q\nwant\n%q", tc.name, tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	m := newTestMapper(t)
+	r := NewRewriter(m, "")
+
+	buf := bytes.Buffer{}
+	w := r.Writer(&buf)
+	for _, chunk := range []string{"ok " + testExecRoot[:10], testExecRoot[10:] + "/a/a.go:1\nnext ", "a/a.go"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := buf.String(), "ok /gopath/src/p.com/a/a.go:1\n"; got != want {
+		t.Errorf("written before Close %q, want %q", got, want)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "ok /gopath/src/p.com/a/a.go:1\nnext /gopath/src/p.com/a/a.go"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+}
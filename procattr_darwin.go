@@ -0,0 +1,11 @@
+package main
+
+import (
+	"syscall"
+)
+
+// dlvProcAttr returns the default attributes. There is no parent death
+// signal on darwin, dlv is stopped through gobazel's signal handler.
+func dlvProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
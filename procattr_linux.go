@@ -0,0 +1,12 @@
+package main
+
+import (
+	"syscall"
+)
+
+// dlvProcAttr makes sure dlv is killed when gobazel dies.
+func dlvProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+	}
+}
@@ -0,0 +1,365 @@
+package testjson
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+// Event is a test2json event, as printed by "go test -json".
+type Event struct {
+	Time    time.Time `json:",omitempty"`
+	Action  string
+	Package string  `json:",omitempty"`
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"`
+	Output  string  `json:",omitempty"`
+}
+
+type testSuites struct {
+	Suites []testSuite `xml:"testsuite"`
+}
+
+type testSuite struct {
+	Name      string     `xml:"name,attr"`
+	Time      string     `xml:"time,attr"`
+	Timestamp string     `xml:"timestamp,attr"`
+	Cases     []testCase `xml:"testcase"`
+	SystemOut string     `xml:"system-out"`
+}
+
+type testCase struct {
+	Name      string      `xml:"name,attr"`
+	ClassName string      `xml:"classname,attr"`
+	Time      string      `xml:"time,attr"`
+	Failure   *testResult `xml:"failure"`
+	Error     *testResult `xml:"error"`
+	Skipped   *testResult `xml:"skipped"`
+	SystemOut string      `xml:"system-out"`
+}
+
+type testResult struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// Converter converts bazel test results into test2json events.
+type Converter struct {
+	enc *json.Encoder
+	rw  *pathmap.Rewriter
+}
+
+// Convert reads the test.xml files (one per shard) of a bazel test target
+// from its bazel-testlogs directory, and writes them as test2json events of
+// the given Go package.
+func (c *Converter) Convert(testDir, pkg string) error {
+	files := []string{filepath.Join(testDir, "test.xml")}
+	if _, err := os.Stat(files[0]); err != nil {
+		if files, err = filepath.Glob(filepath.Join(testDir, "shard_*", "test.xml")); err != nil || len(files) == 0 {
+			return fmt.Errorf("no test.xml found in %s", testDir)
+		}
+		sort.Strings(files)
+	}
+
+	runs := []suiteRun{}
+	for _, file := range files {
+		suites, err := parseTestXML(file)
+		if err != nil {
+			return err
+		}
+		// Suites without a timestamp ended when test.xml was written.
+		end := time.Now()
+		if fi, err := os.Stat(file); err == nil {
+			end = fi.ModTime()
+		}
+		for i := range suites {
+			suite := &suites[i]
+			start, err := time.Parse(time.RFC3339Nano, suite.Timestamp)
+			if err != nil {
+				start = end.Add(-seconds(suite.Time))
+			}
+			runs = append(runs, suiteRun{suite, start, filepath.Join(filepath.Dir(file), "test.log")})
+		}
+	}
+	if len(runs) == 0 {
+		return fmt.Errorf("no test suite found in %s", testDir)
+	}
+
+	// Shards run in parallel, the package ran from the first start to the
+	// last end.
+	start, end := runs[0].start, runs[0].start
+	for _, run := range runs {
+		if run.start.Before(start) {
+			start = run.start
+		}
+		if e := run.start.Add(seconds(run.suite.Time)); e.After(end) {
+			end = e
+		}
+	}
+	c.emit(Event{Time: start, Action: "start", Package: pkg})
+
+	failed := false
+	for _, run := range runs {
+		if c.convertSuite(pkg, run) {
+			failed = true
+		}
+	}
+
+	action, summary := "pass", "ok  "
+	if failed {
+		action, summary = "fail", "FAIL"
+	}
+	elapsed := end.Sub(start).Seconds()
+	c.emit(Event{Time: end, Action: "output", Package: pkg, Output: fmt.Sprintf("%s\t%s\t%.3fs\n", summary, pkg, elapsed)})
+	c.emit(Event{Time: end, Action: action, Package: pkg, Elapsed: elapsed})
+	return nil
+}
+
+// suiteRun is a test suite with the time it started and its test log.
+type suiteRun struct {
+	suite   *testSuite
+	start   time.Time
+	testLog string
+}
+
+// convertSuite emits the events of a test suite and reports whether it
+// failed.
+func (c *Converter) convertSuite(pkg string, run suiteRun) bool {
+	suite := run.suite
+
+	// Without per test results (bazel's generic test.xml), report the test
+	// log as the package output.
+	if len(suite.Cases) <= 1 && !isGoTestName(suite.Cases) {
+		failed := false
+		out := suite.SystemOut
+		if len(suite.Cases) == 1 {
+			tc := suite.Cases[0]
+			out += tc.SystemOut
+			failed = tc.Failure != nil || tc.Error != nil
+		}
+		if b, err := ioutil.ReadFile(run.testLog); err == nil {
+			out = string(b)
+		}
+		c.emitOutput(run.start, pkg, "", out)
+		return failed
+	}
+
+	// Top level tests run one after the other, and so do the subtests of a
+	// test, from its start on.
+	failed := false
+	ts := run.start
+	for _, tc := range nestCases(suite.Cases, "") {
+		if c.convertCase(ts, pkg, tc) {
+			failed = true
+		}
+		ts = ts.Add(seconds(tc.Time))
+	}
+	return failed
+}
+
+// testNode is a test case with its subtests.
+type testNode struct {
+	*testCase
+	subtests []*testNode
+}
+
+// nestCases returns the test cases below the given parent test ("" for the
+// top level) in the order of the test.xml.
+func nestCases(cases []testCase, parent string) []*testNode {
+	prefix := ""
+	if parent != "" {
+		prefix = parent + "/"
+	}
+	nodes := []*testNode{}
+	for i := range cases {
+		tc := &cases[i]
+		if !strings.HasPrefix(tc.Name, prefix) || tc.Name == parent {
+			continue
+		}
+		// Subtests of missing tests go to their closest ancestor.
+		if p := parentCase(cases, tc.Name); p != parent {
+			continue
+		}
+		nodes = append(nodes, &testNode{testCase: tc, subtests: nestCases(cases, tc.Name)})
+	}
+	return nodes
+}
+
+// parentCase returns the name of the closest test case which the named
+// test is a subtest of, or "".
+func parentCase(cases []testCase, name string) string {
+	for idx := strings.LastIndex(name, "/"); idx > 0; idx = strings.LastIndex(name, "/") {
+		name = name[:idx]
+		for i := range cases {
+			if cases[i].Name == name {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// convertCase emits the events of a test and its subtests started at ts, and
+// reports whether it failed.
+func (c *Converter) convertCase(ts time.Time, pkg string, tc *testNode) bool {
+	c.emit(Event{Time: ts, Action: "run", Package: pkg, Test: tc.Name})
+	c.emitOutput(ts, pkg, tc.Name, fmt.Sprintf("=== RUN   %s\n", tc.Name))
+	c.emitOutput(ts, pkg, tc.Name, tc.SystemOut)
+
+	failed := false
+	sub := ts
+	for _, st := range tc.subtests {
+		if c.convertCase(sub, pkg, st) {
+			failed = true
+		}
+		sub = sub.Add(seconds(st.Time))
+	}
+
+	elapsed := parseSeconds(tc.Time)
+	end := ts.Add(seconds(tc.Time))
+	action := "pass"
+	switch {
+	case tc.Failure != nil:
+		action = "fail"
+		c.emitOutput(end, pkg, tc.Name, testOutput(resultOutput(tc.Failure)))
+	case tc.Error != nil:
+		action = "fail"
+		c.emitOutput(end, pkg, tc.Name, testOutput(resultOutput(tc.Error)))
+	case tc.Skipped != nil:
+		action = "skip"
+		c.emitOutput(end, pkg, tc.Name, testOutput(resultOutput(tc.Skipped)))
+	case failed:
+		action = "fail"
+	}
+
+	indent := strings.Repeat("    ", strings.Count(tc.Name, "/"))
+	c.emitOutput(end, pkg, tc.Name, fmt.Sprintf("%s--- %s: %s (%.2fs)\n", indent, strings.ToUpper(action), tc.Name, elapsed))
+	c.emit(Event{Time: end, Action: action, Package: pkg, Test: tc.Name, Elapsed: elapsed})
+	return action == "fail"
+}
+
+func (c *Converter) emitOutput(ts time.Time, pkg, test, out string) {
+	if out == "" {
+		return
+	}
+	for _, line := range strings.SplitAfter(out, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		c.emit(Event{Time: ts, Action: "output", Package: pkg, Test: test, Output: c.rw.Rewrite(line)})
+	}
+}
+
+func (c *Converter) emit(e Event) {
+	c.enc.Encode(&e)
+}
+
+func unmarshalTestXML(file string) ([]testSuite, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// The root element is either <testsuites> or a single <testsuite>.
+	suites := testSuites{}
+	if err := xml.Unmarshal(b, &suites); err == nil && len(suites.Suites) > 0 {
+		return suites.Suites, nil
+	}
+	suite := testSuite{}
+	if err := xml.Unmarshal(b, &suite); err != nil {
+		return nil, fmt.Errorf("failed to parse %s, %v", file, err)
+	}
+	return []testSuite{suite}, nil
+}
+
+// parseTestXML returns the test suites of a test.xml, with their run time
+// added up from the top level tests where it's missing.
+func parseTestXML(file string) ([]testSuite, error) {
+	suites, err := unmarshalTestXML(file)
+	if err != nil {
+		return nil, err
+	}
+	for i := range suites {
+		suite := &suites[i]
+		if suite.Time != "" {
+			continue
+		}
+		total := 0.0
+		for _, tc := range suite.Cases {
+			if parentCase(suite.Cases, tc.Name) == "" {
+				total += parseSeconds(tc.Time)
+			}
+		}
+		suite.Time = strconv.FormatFloat(total, 'f', -1, 64)
+	}
+	return suites, nil
+}
+
+func isGoTestName(cases []testCase) bool {
+	for _, tc := range cases {
+		for _, prefix := range []string{"Test", "Example", "Benchmark", "Fuzz"} {
+			if strings.HasPrefix(tc.Name, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func resultOutput(r *testResult) string {
+	if strings.TrimSpace(r.Body) != "" {
+		return r.Body
+	}
+	if r.Message != "" {
+		return r.Message + "\n"
+	}
+	return ""
+}
+
+// testOutput drops the "=== RUN" and "--- PASS/FAIL/SKIP" lines rules_go
+// copies into the results, the events of the test and its subtests have
+// them already.
+func testOutput(out string) string {
+	b := strings.Builder{}
+	for _, line := range strings.SplitAfter(out, "\n") {
+		l := strings.TrimSpace(line)
+		if strings.HasPrefix(l, "=== RUN ") || strings.HasPrefix(l, "--- PASS: ") ||
+			strings.HasPrefix(l, "--- FAIL: ") || strings.HasPrefix(l, "--- SKIP: ") {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+func parseSeconds(s string) float64 {
+	f, _ := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64)
+	return f
+}
+
+func seconds(s string) time.Duration {
+	return time.Duration(math.Round(parseSeconds(s) * float64(time.Second)))
+}
+
+// NewConverter returns a new Converter writing events to w, with paths in
+// the test output rewritten by rw.
+func NewConverter(w io.Writer, rw *pathmap.Rewriter) *Converter {
+	return &Converter{
+		enc: json.NewEncoder(w),
+		rw:  rw,
+	}
+}
@@ -0,0 +1,56 @@
+package testjson
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linuxerwang/gobazel/conf"
+	"github.com/linuxerwang/gobazel/pathmap"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestConvert(t *testing.T) {
+	cfg := &conf.GobazelConf{GoPkgPrefix: "p.com"}
+	rw := pathmap.NewRewriter(pathmap.New(cfg, "/ws", "/gopath/src"), "")
+
+	for _, name := range []string{"rules_go", "generic"} {
+		// The generic test.xml has no timestamp, it's taken from the file.
+		xmlFile := filepath.Join("testdata", name, "test.xml")
+		mtime := time.Date(2023, 5, 4, 10, 20, 30, 0, time.UTC)
+		if err := os.Chtimes(xmlFile, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.Buffer{}
+		if err := NewConverter(&buf, rw).Convert(filepath.Join("testdata", name), "p.com/a"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		golden := filepath.Join("testdata", name+".json")
+		if *update {
+			if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != string(want) {
+			t.Errorf("%s: converted to\n%s\nwant\n%s", name, got, want)
+		}
+	}
+}
+
+func TestConvertMissing(t *testing.T) {
+	rw := pathmap.NewRewriter(pathmap.New(&conf.GobazelConf{}, "/ws", "/gopath/src"), "")
+	if err := NewConverter(ioutil.Discard, rw).Convert(filepath.Join("testdata", "missing"), "p.com/a"); err == nil {
+		t.Error("converted missing test results")
+	}
+}